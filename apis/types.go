@@ -23,3 +23,11 @@ type DatabaseConfigSpec struct {
 	Username          string                 `json:"username"`
 	PasswordSecretRef rtv1.SecretKeySelector `json:"passwordSecretRef"`
 }
+
+// AnnotationMapping associates an annotation label with the tables storing the resources found with it
+type AnnotationMapping struct {
+	Label string `json:"label"`
+	Table string `json:"table"`
+	// CompositionTable stores the resources of the composition instances, they are not stored if empty
+	CompositionTable string `json:"compositionTable,omitempty"`
+}
@@ -0,0 +1,276 @@
+package chart
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// documentSeparator matches the YAML document separators of a (template) file
+	documentSeparator = regexp.MustCompile(`(?m)^---[ \t]*(#.*)?$`)
+	// templateAction matches a single go template action, possibly spanning multiple lines
+	templateAction = regexp.MustCompile(`(?s){{.*?}}`)
+	// templatePlaceholder matches the placeholders that replace the template actions before decoding
+	templatePlaceholder = regexp.MustCompile(`__finops_template_(\d+)__`)
+)
+
+// ManifestResources holds the finops resources found in the annotations of a single manifest
+type ManifestResources struct {
+	APIVersion string
+	Kind       string
+	Name       string
+	Resources  []ResourceQuantity
+	// Errors reports the entries of the annotation that could not be evaluated
+	Errors []EntryError
+}
+
+// manifestDocument is the subset of a Kubernetes manifest needed to read the annotations
+type manifestDocument struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name        string                 `yaml:"name"`
+		Annotations map[string]interface{} `yaml:"annotations"`
+	} `yaml:"metadata"`
+}
+
+// ExtractManifestResources decodes every YAML document in the content and reads the finops resources
+// only from metadata.annotations[annotationKey] of each of them. Go template actions are masked before
+// decoding and restored in the values read from the document; documents that still cannot be decoded
+// are scanned line by line. Templates in the annotation values are resolved against the given values
+func ExtractManifestResources(content, annotationKey string, values *ValuesFile) ([]ManifestResources, error) {
+	var manifests []ManifestResources
+
+	for _, documentContent := range documentSeparator.Split(content, -1) {
+		if !strings.Contains(documentContent, annotationKey) {
+			continue
+		}
+
+		masked, actions := maskTemplateActions(documentContent)
+
+		document := manifestDocument{}
+		if err := yaml.Unmarshal([]byte(masked), &document); err != nil {
+			log.Warn().Err(err).Msg("could not decode document as YAML, scanning it line by line")
+			resources, entryErrors, err := ExtractFinopsResources(documentContent, annotationKey, values)
+			if err != nil {
+				return nil, err
+			}
+			if len(resources) > 0 || len(entryErrors) > 0 {
+				manifests = append(manifests, ManifestResources{Resources: resources, Errors: entryErrors})
+			}
+			continue
+		}
+
+		annotation, ok := document.Metadata.Annotations[annotationKey]
+		if !ok || annotation == nil {
+			continue
+		}
+
+		var value string
+		switch v := annotation.(type) {
+		case string:
+			value = v
+		default:
+			// The annotation was not quoted, e.g. a YAML flow sequence
+			jsonBytes, err := json.Marshal(v)
+			if err != nil {
+				return nil, fmt.Errorf("error marshalling annotation value: %w", err)
+			}
+			value = string(jsonBytes)
+		}
+
+		resources, entryErrors, err := parseAnnotationValue(strings.TrimSpace(restoreTemplateActions(value, actions)), values)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing annotation of %s %s: %w", document.Kind, document.Metadata.Name, err)
+		}
+
+		manifests = append(manifests, ManifestResources{
+			APIVersion: restoreTemplateActions(document.APIVersion, actions),
+			Kind:       restoreTemplateActions(document.Kind, actions),
+			Name:       restoreTemplateActions(document.Metadata.Name, actions),
+			Resources:  resources,
+			Errors:     entryErrors,
+		})
+	}
+
+	return manifests, nil
+}
+
+// maskTemplateActions replaces the template actions of a document with placeholders, so that it can be
+// decoded as YAML. Lines that only contain template actions (e.g. if/range/end, include) are dropped
+func maskTemplateActions(content string) (string, []string) {
+	var actions []string
+	masked := templateAction.ReplaceAllStringFunc(content, func(action string) string {
+		actions = append(actions, action)
+		return fmt.Sprintf("__finops_template_%d__", len(actions)-1)
+	})
+
+	lines := strings.Split(masked, "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && strings.TrimSpace(templatePlaceholder.ReplaceAllString(trimmed, "")) == "" {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "\n"), actions
+}
+
+// restoreTemplateActions puts back the template actions replaced by maskTemplateActions
+func restoreTemplateActions(value string, actions []string) string {
+	return templatePlaceholder.ReplaceAllStringFunc(value, func(placeholder string) string {
+		var index int
+		if _, err := fmt.Sscanf(placeholder, "__finops_template_%d__", &index); err != nil || index >= len(actions) {
+			return placeholder
+		}
+		return actions[index]
+	})
+}
+
+// Provenance identifies the chart manifest that contributed a finops resource
+type Provenance struct {
+	Template string `json:"template"`
+	// Chart is the name of the chart or subchart owning the template
+	Chart      string `json:"chart,omitempty"`
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Name       string `json:"name,omitempty"`
+	// Quantity and Unit are the ones declared by the manifest for the resource, left out for the resources
+	// counted once without a unit, so that their provenance is stored as before the quantities
+	Quantity *float64 `json:"quantity,omitempty"`
+	Unit     string   `json:"unit,omitempty"`
+	// Source is where the resource was declared: a template, the values or the Chart.yaml annotations
+	Source string `json:"source,omitempty"`
+}
+
+// ProcessResult is the result of the extraction of the finops resources from a chart
+type ProcessResult struct {
+	// Counts maps each finops resource to its quantity summed over the chart, resources listed by name count 1
+	Counts map[string]float64
+	// Provenance maps each finops resource to the manifests it was found in
+	Provenance map[string][]Provenance
+	// Sources maps each finops resource to the source its quantity was taken from
+	Sources map[string]string
+	// ChartVersion is the version declared in the Chart.yaml of the processed chart, if available
+	ChartVersion string
+	// Errors reports the annotation entries that could not be evaluated and were not counted
+	Errors []EntryError
+}
+
+// ProcessResults maps each annotation label to the result of its extraction from the same chart
+type ProcessResults map[string]*ProcessResult
+
+func newProcessResults(annotationLabels []string) ProcessResults {
+	results := ProcessResults{}
+	for _, annotationLabel := range annotationLabels {
+		results[annotationLabel] = newProcessResult()
+	}
+	return results
+}
+
+func (r ProcessResults) setChartVersion(chartVersion string) {
+	for _, result := range r {
+		result.ChartVersion = chartVersion
+	}
+}
+
+func (r ProcessResults) logCounts() {
+	for annotationLabel, result := range r {
+		for key := range result.Counts {
+			log.Debug().Msgf("%s key: %s, value: %g", annotationLabel, key, result.Counts[key])
+		}
+	}
+}
+
+func newProcessResult() *ProcessResult {
+	return &ProcessResult{
+		Counts:     map[string]float64{},
+		Provenance: map[string][]Provenance{},
+		Sources:    map[string]string{},
+	}
+}
+
+// add records the resources of a manifest found in the given template file
+func (r *ProcessResult) add(template string, manifest ManifestResources) {
+	r.addFrom(SourceTemplate, template, manifest)
+}
+
+// addDeclared records the resources declared by an annotation value in a values.yaml or Chart.yaml file
+func (r *ProcessResult) addDeclared(source, file, value string, values *ValuesFile) {
+	resources, entryErrors, err := parseAnnotationValue(value, values)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error processing the resources declared in %s", file)
+		return
+	}
+	log.Info().Msgf("Found resources declared in %s: %v", file, resources)
+	r.addFrom(source, file, ManifestResources{Resources: resources, Errors: entryErrors})
+}
+
+// addFrom records the resources of a manifest found in the given file of the given source
+func (r *ProcessResult) addFrom(source, template string, manifest ManifestResources) {
+	provenance := Provenance{
+		Template:   template,
+		Chart:      templateChart(template),
+		APIVersion: manifest.APIVersion,
+		Kind:       manifest.Kind,
+		Name:       manifest.Name,
+		Source:     source,
+	}
+	for _, resource := range manifest.Resources {
+		r.Counts[resource.Resource] += resource.Quantity
+		r.Sources[resource.Resource] = source
+		entryProvenance := provenance
+		if resource.Quantity != 1 || resource.Unit != "" {
+			quantity := resource.Quantity
+			entryProvenance.Quantity = &quantity
+			entryProvenance.Unit = resource.Unit
+		}
+		r.Provenance[resource.Resource] = append(r.Provenance[resource.Resource], entryProvenance)
+	}
+	for _, entryError := range manifest.Errors {
+		entryError.Provenance = provenance
+		r.Errors = append(r.Errors, entryError)
+	}
+}
+
+// mergeDeclared adds the resources of a lower precedence source, for the resources not found so far. The
+// errors of the entries of resources already found are ignored with them
+func (r *ProcessResult) mergeDeclared(declared *ProcessResult) {
+	for _, entryError := range declared.Errors {
+		if _, ok := r.Counts[entryError.Resource]; ok && entryError.Resource != "" {
+			continue
+		}
+		r.Errors = append(r.Errors, entryError)
+	}
+	for resource, count := range declared.Counts {
+		if _, ok := r.Counts[resource]; ok {
+			log.Debug().Msgf("ignoring %s declared in %s, already found in %s", resource, declared.Sources[resource], r.Sources[resource])
+			continue
+		}
+		r.Counts[resource] = count
+		r.Provenance[resource] = declared.Provenance[resource]
+		r.Sources[resource] = declared.Sources[resource]
+	}
+}
+
+// templateChart returns the name of the chart owning a template, given its path as reported by the helm
+// engine, e.g. "redis" for "parent/charts/redis/templates/deployment.yaml", or owning a file at the root of
+// the chart, e.g. "redis" for "parent/charts/redis/values.yaml"
+func templateChart(template string) string {
+	parts := strings.Split(template, "/")
+	for i := len(parts) - 1; i > 0; i-- {
+		if parts[i] == "templates" {
+			return parts[i-1]
+		}
+	}
+	if base := parts[len(parts)-1]; len(parts) > 1 && (base == "values.yaml" || base == "Chart.yaml") {
+		return parts[len(parts)-2]
+	}
+	return ""
+}
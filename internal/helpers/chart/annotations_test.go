@@ -0,0 +1,67 @@
+package chart
+
+import (
+	"testing"
+)
+
+func TestExtractManifestResources(t *testing.T) {
+	const (
+		label    = "krateo-finops-focus-resource"
+		template = `# krateo-finops-focus-resource: ["commented"]
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}-first
+  labels:
+    krateo-finops-focus-resource: "not-an-annotation"
+  annotations:
+    krateo-finops-focus-resource: '["{{ .Values.sku }}", "Storage"]'
+---
+{{- if .Values.enabled }}
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: second
+  annotations:
+    {{- with .Values.extra }}
+    extra: {{ . }}
+    {{- end }}
+    krateo-finops-focus-resource: '["Compute"]'
+{{- end }}
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: third
+data:
+  note: krateo-finops-focus-resource
+`
+	)
+
+	values := &ValuesFile{Values: map[string]interface{}{"sku": "Standard_B1s"}}
+
+	manifests, err := ExtractManifestResources(template, label, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifests) != 2 {
+		t.Fatalf("expected 2 annotated manifests, got %d: %v", len(manifests), manifests)
+	}
+
+	first := manifests[0]
+	if first.Kind != "ConfigMap" || first.Name != "{{ .Release.Name }}-first" {
+		t.Fatalf("unexpected provenance for first manifest: %s %s", first.Kind, first.Name)
+	}
+	if len(first.Resources) != 2 || first.Resources[0].Resource != "Standard_B1s" || first.Resources[1].Resource != "Storage" {
+		t.Fatalf("unexpected resources for first manifest: %v", first.Resources)
+	}
+
+	second := manifests[1]
+	if second.APIVersion != "apps/v1" || second.Kind != "Deployment" || second.Name != "second" {
+		t.Fatalf("unexpected provenance for second manifest: %s %s %s", second.APIVersion, second.Kind, second.Name)
+	}
+	if len(second.Resources) != 1 || second.Resources[0].Resource != "Compute" {
+		t.Fatalf("unexpected resources for second manifest: %v", second.Resources)
+	}
+}
@@ -1,20 +1,18 @@
 package chart
 
 import (
-	"archive/tar"
-	"bytes"
-	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v3"
-	"k8s.io/client-go/rest"
+	helmchart "helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	sigsyaml "sigs.k8s.io/yaml"
 
 	getter "finops-composition-definition-parser/internal/helpers/chart/getter"
 	secretsHelper "finops-composition-definition-parser/internal/helpers/kube/secrets"
@@ -36,6 +34,8 @@ type ChartEntry struct {
 // ValuesFile represents the structure of values.yaml
 type ValuesFile struct {
 	Values map[string]interface{}
+	// Chart is the metadata of the chart the values belong to, available as .Chart to the templates
+	Chart *helmchart.Metadata
 }
 
 // LoadValuesFile loads and parses the values.yaml file
@@ -57,148 +57,100 @@ func LoadValuesFile(chartPath string) (*ValuesFile, error) {
 	return values, nil
 }
 
-// resolveTemplateValue resolves a template expression like "{{ .Values.something.key }}"
-// to its actual value from values.yaml
-func resolveTemplateValue(templateExpr string, values *ValuesFile) (string, error) {
-	// Remove {{ }} and spaces, handling potential whitespace between braces
-	clean := strings.TrimSpace(templateExpr)
-	if strings.HasPrefix(clean, "{{") && strings.HasSuffix(clean, "}}") {
-		clean = clean[2 : len(clean)-2]
-	}
-	clean = strings.TrimSpace(clean)
-
-	// Remove .Values. prefix
-	clean = strings.TrimPrefix(clean, ".Values.")
-
-	// If the path is empty after cleaning, return an error
-	if clean == "" {
-		return "", fmt.Errorf("empty template path after cleaning")
-	}
-
-	// Split the path
-	parts := strings.Split(clean, ".")
-
-	// Navigate through the values map
-	var current interface{} = values.Values
-	for _, part := range parts {
-		part = strings.TrimSpace(part) // Handle any whitespace between path components
-		if part == "" {
-			continue // Skip empty parts
-		}
-
-		switch v := current.(type) {
-		case map[string]interface{}:
-			var ok bool
-			current, ok = v[part]
-			if !ok {
-				return "", fmt.Errorf("key %s not found in values", part)
-			}
-		default:
-			return "", fmt.Errorf("invalid path in values.yaml")
-		}
+// ChartInfoFromSpec downloads the chart and extracts it in extractPath within the given limits, returning
+// the root directory of the chart, i.e. the directory containing its Chart.yaml
+func ChartInfoFromSpec(nfo *coreprovider.ChartInfo, extractPath string, limits ExtractLimits, secrets *secretsHelper.Accessor) (rootDir string, err error) {
+	dat, err := fetchChart(nfo, secrets)
+	if err != nil {
+		return "", err
 	}
-
-	// Convert the final value to string
-	switch v := current.(type) {
-	case string:
-		return v, nil
-	case []interface{}:
-		// Handle array values
-		jsonBytes, err := json.Marshal(v)
-		if err != nil {
-			return "", fmt.Errorf("error marshalling array value: %w", err)
-		}
-		return string(jsonBytes), nil
-	default:
-		return fmt.Sprintf("%v", v), nil
+	if err := ExtractTgz(dat, extractPath, limits); err != nil {
+		return "", err
 	}
+	return FindChartRoot(extractPath)
 }
 
-func ChartInfoFromSpec(nfo *coreprovider.ChartInfo, extractPath string, rc *rest.Config) (rootDir string, err error) {
+// fetchChart downloads the chart archive described by the chart infos
+func fetchChart(nfo *coreprovider.ChartInfo, secrets *secretsHelper.Accessor) ([]byte, error) {
 	if nfo == nil {
-		return "", fmt.Errorf("chart infos cannot be nil")
+		return nil, fmt.Errorf("chart infos cannot be nil")
 	}
 
-	opts := getter.GetOptions{
+	repository, err := RepositoryFromSpec(nfo, secrets)
+	if err != nil {
+		return nil, err
+	}
+	dat, _, err := getter.Get(getter.GetOptions{
 		URI:                   nfo.Url,
 		Version:               nfo.Version,
 		Repo:                  nfo.Repo,
-		InsecureSkipVerifyTLS: nfo.InsecureSkipVerifyTLS,
+		InsecureSkipVerifyTLS: repository.InsecureSkipVerifyTLS,
+		Username:              repository.Username,
+		Password:              repository.Password,
+		PassCredentialsAll:    repository.Username != "",
+	})
+	return dat, err
+}
+
+// ChartRepository is where a chart is downloaded from, with the settings used to download it
+type ChartRepository struct {
+	URL                   string
+	Username              string
+	Password              string
+	InsecureSkipVerifyTLS bool
+}
+
+// RepositoryFromSpec returns the repository of the chart infos, with the password of its credentials, if any
+func RepositoryFromSpec(nfo *coreprovider.ChartInfo, secrets *secretsHelper.Accessor) (ChartRepository, error) {
+	if nfo == nil {
+		return ChartRepository{}, fmt.Errorf("chart infos cannot be nil")
 	}
 
+	repository := ChartRepository{URL: nfo.Url, InsecureSkipVerifyTLS: nfo.InsecureSkipVerifyTLS}
 	if nfo.Credentials != nil {
-		secret, err := secretsHelper.Get(context.TODO(), rc, &nfo.Credentials.PasswordRef)
+		password, err := secrets.Value(context.TODO(), &nfo.Credentials.PasswordRef)
 		if err != nil {
-			return "", fmt.Errorf("failed to get secret: %w", err)
+			return ChartRepository{}, fmt.Errorf("failed to get secret: %w", err)
 		}
-		opts.Username = nfo.Credentials.Username
-		opts.Password = string(secret.Data[nfo.Credentials.PasswordRef.Key])
-		opts.PassCredentialsAll = true
-	}
-
-	dat, _, err := getter.Get(opts)
-	if err != nil {
-		return "", err
+		repository.Username = nfo.Credentials.Username
+		repository.Password = password
 	}
-	return "", downloadAndExtractTgz(dat, extractPath)
+	return repository, nil
 }
 
-// DownloadAndExtractTgz downloads a tgz file from a URL and extracts it
-func downloadAndExtractTgz(tgz []byte, extractPath string) error {
-	// Create a gzip reader
-	bytesReader := bytes.NewReader(tgz)
-	gzr, err := gzip.NewReader(bytesReader)
-	if err != nil {
-		return fmt.Errorf("error creating gzip reader: %v", err)
-	}
-	defer gzr.Close()
-
-	// Create a tar reader
-	tr := tar.NewReader(gzr)
-
-	// Extract the contents
-	log.Debug().Msgf("Extracting to %s...", extractPath)
-	for {
-		header, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
+// FindChartRoot returns the shallowest directory under extractPath containing a Chart.yaml,
+// since the root of the tarball does not necessarily match the chart or repo name
+func FindChartRoot(extractPath string) (string, error) {
+	rootDir := ""
+	rootDepth := -1
+	err := filepath.WalkDir(extractPath, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
-			return fmt.Errorf("error reading tar: %v", err)
-		}
-
-		// Create the directory structure
-		target := filepath.Join(extractPath, header.Name)
-		dir := filepath.Dir(target)
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("error creating directory: path %s - err %v", dir, err)
-		}
-
-		if header.Typeflag == tar.TypeDir {
-			continue
+			return err
 		}
-
-		// Create the file
-		file, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
-		if err != nil {
-			return fmt.Errorf("error creating file: %v", err)
+		if d.IsDir() || d.Name() != "Chart.yaml" {
+			return nil
 		}
-		defer file.Close()
 
-		// Copy the contents
-		if _, err := io.Copy(file, tr); err != nil {
-			return fmt.Errorf("error copying file contents: %v", err)
+		dir := filepath.Dir(path)
+		depth := strings.Count(filepath.ToSlash(dir), "/")
+		if rootDepth == -1 || depth < rootDepth {
+			rootDir = dir
+			rootDepth = depth
 		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("error looking for Chart.yaml: %w", err)
 	}
-
-	log.Debug().Msg("Download and extraction completed successfully!")
-	return nil
+	if rootDir == "" {
+		return "", fmt.Errorf("no Chart.yaml found in %s", extractPath)
+	}
+	return rootDir, nil
 }
 
-// ExtractFinopsResources extracts the finops resources from the file content
-func ExtractFinopsResources(content, annotationKey string, chartPath string) ([]string, error) {
-	var resources []string
-
+// ExtractFinopsResources extracts the finops resources from the file content by scanning it line by line.
+// It is used as a fallback for documents that cannot be decoded as YAML
+func ExtractFinopsResources(content, annotationKey string, values *ValuesFile) ([]ResourceQuantity, []EntryError, error) {
 	if strings.Contains(content, annotationKey) {
 		lines := strings.Split(content, "\n")
 		for _, line := range lines {
@@ -213,119 +165,220 @@ func ExtractFinopsResources(content, annotationKey string, chartPath string) ([]
 				// Remove surrounding quotes if present
 				valuePart = strings.Trim(valuePart, "'\"")
 
-				// First try to unmarshal as is
-				err := json.Unmarshal([]byte(valuePart), &resources)
-				if err == nil {
-					// If successful, check each resource for templates
-					for i, resource := range resources {
-						if strings.Contains(resource, "{{") && strings.Contains(resource, "}}") {
-							values, err := LoadValuesFile(chartPath)
-							if err != nil {
-								log.Warn().Err(err).Msg("Failed to load values.yaml, using template as-is")
-								continue
-							}
+				return parseAnnotationValue(valuePart, values)
+			}
+		}
+	}
+	return nil, nil, nil
+}
 
-							resolved, err := resolveTemplateValue(resource, values)
-							if err != nil {
-								log.Warn().Err(err).Msg("Failed to resolve template value, using template as-is")
-								continue
-							}
-							resources[i] = resolved
-						}
-					}
-					return resources, nil
-				}
+// parseAnnotationValue parses an annotation value, evaluating the templates it contains against the values
+// of the chart. The value is either a JSON array of resource names, counted once each, or a JSON or YAML
+// entry or list of entries with a resource, a quantity and a unit. Entries that cannot be evaluated are
+// reported as entry errors
+func parseAnnotationValue(valuePart string, values *ValuesFile) ([]ResourceQuantity, []EntryError, error) {
+	// First try to unmarshal as is, templates are then evaluated entry by entry
+	var decoded interface{}
+	err := json.Unmarshal([]byte(valuePart), &decoded)
+	if err != nil && containsTemplate(valuePart) {
+		// If direct unmarshal failed, the entire value may be a template, e.g. {{ .Values.list | toJson }}
+		resolved, err := evaluateTemplate(valuePart, values)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed to evaluate annotation %s", valuePart)
+			return nil, []EntryError{{Entry: valuePart, Err: err.Error()}}, nil
+		}
+		valuePart = resolved
+	}
+	if err != nil {
+		// JSON is valid YAML, the YAML decoder also accepts block entries
+		decoded = nil
+		if err := yaml.Unmarshal([]byte(valuePart), &decoded); err != nil {
+			return nil, nil, fmt.Errorf("error parsing annotation value: %v", err)
+		}
+	}
 
-				// If direct unmarshal failed, try to resolve any templates first
-				if strings.Contains(valuePart, "{{") && strings.Contains(valuePart, "}}") {
-					// This is for handling the entire array as a template
-					values, err := LoadValuesFile(chartPath)
-					if err != nil {
-						log.Warn().Err(err).Msg("Failed to load values.yaml, using template as-is")
-					} else {
-						resolved, err := resolveTemplateValue(valuePart, values)
-						if err != nil {
-							log.Warn().Err(err).Msg("Failed to resolve template value, using template as-is")
-						} else {
-							valuePart = resolved
-						}
-					}
-				}
+	var entries []interface{}
+	switch v := decoded.(type) {
+	case []interface{}:
+		entries = v
+	case map[string]interface{}:
+		entries = []interface{}{v}
+	default:
+		return nil, nil, fmt.Errorf("error parsing annotation value: expected a list or an object, got %q", valuePart)
+	}
 
-				// Try to unmarshal again after template resolution
-				err = json.Unmarshal([]byte(valuePart), &resources)
-				if err != nil {
-					return nil, fmt.Errorf("error parsing annotation value: %v", err)
-				}
-				return resources, nil
-			}
+	resources := make([]ResourceQuantity, 0, len(entries))
+	var entryErrors []EntryError
+	for _, entry := range entries {
+		resource, err := parseResourceEntry(entry, values)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed to evaluate annotation entry %v", entry)
+			entryErrors = append(entryErrors, EntryError{Resource: resource.Resource, Entry: entryString(entry), Err: err.Error()})
+			continue
 		}
+		resources = append(resources, resource)
 	}
-	return nil, nil
+	return resources, entryErrors, nil
 }
 
-// ProcessTemplateFile processes a single template file
-func ProcessTemplateFile(filePath, annotationLabel, chartPath string) ([]string, error) {
+// ProcessTemplateFile processes a single template file, returning the manifests found for each annotation label.
+// The templates of the annotations are evaluated against the values of the chart owning the file, if not nil
+func ProcessTemplateFile(filePath string, annotationLabels []string, values *ValuesFile) (map[string][]ManifestResources, error) {
 	content, err := os.ReadFile(filePath)
 	if err != nil {
-		return []string{}, fmt.Errorf("error reading file: %v", err)
+		return nil, fmt.Errorf("error reading file: %v", err)
 	}
 
 	log.Debug().Msgf("Processing %s:", filepath.Base(filePath))
 
-	resources, err := ExtractFinopsResources(string(content), annotationLabel, chartPath)
-	if err != nil {
-		return []string{}, fmt.Errorf("error extracting resources: %v", err)
-	}
+	manifestsByLabel := map[string][]ManifestResources{}
+	for _, annotationLabel := range annotationLabels {
+		manifests, err := ExtractManifestResources(string(content), annotationLabel, values)
+		if err != nil {
+			return nil, fmt.Errorf("error extracting resources for %s: %v", annotationLabel, err)
+		}
 
-	if resources != nil {
-		log.Info().Msgf("Found finops resources: %v", resources)
-		for _, resource := range resources {
-			log.Info().Msgf("\t Resource: %s", resource)
+		for _, manifest := range manifests {
+			log.Info().Msgf("Found %s resources in %s %s: %v", annotationLabel, manifest.Kind, manifest.Name, manifest.Resources)
+			for _, resource := range manifest.Resources {
+				log.Info().Msgf("\t Resource: %s", resource)
+			}
 		}
+		manifestsByLabel[annotationLabel] = manifests
+	}
+
+	return manifestsByLabel, nil
+}
+
+// ProcessHelmTemplates loads the chart, including its subcharts, and processes it with ProcessLoadedChart.
+// If the chart cannot be loaded, it falls back to scanning the raw template files
+func ProcessHelmTemplates(chartPath string, annotationLabels []string, opts ProcessOptions) (ProcessResults, error) {
+	chrt, err := loader.Load(chartPath)
+	if err == nil {
+		return ProcessLoadedChart(chrt, annotationLabels, opts)
 	}
 
-	return resources, nil
+	log.Warn().Err(err).Msg("could not load chart, falling back to template scanning")
+	return ScanHelmTemplates(chartPath, annotationLabels)
 }
 
-// ProcessHelmTemplates processes all template files in the chart
-func ProcessHelmTemplates(chartPath, annotationLabel string) (map[string]int, error) {
+// ScanHelmTemplates processes all template files in the chart and in the subcharts unpacked in its
+// charts directory, without rendering them, together with the resources declared in their values.yaml
+// and Chart.yaml annotations
+func ScanHelmTemplates(chartPath string, annotationLabels []string) (ProcessResults, error) {
 	templatesPath := filepath.Join(chartPath, "templates")
 
+	results := newProcessResults(annotationLabels)
 	if _, err := os.Stat(templatesPath); os.IsNotExist(err) {
-		return map[string]int{}, fmt.Errorf("templates directory not found at %s", templatesPath)
+		return results, fmt.Errorf("templates directory not found at %s", templatesPath)
 	}
 
-	resourceMap := map[string]int{}
+	if metadata, err := loadChartMetadata(chartPath); err == nil {
+		results.setChartVersion(metadata.Version)
+	} else {
+		log.Warn().Err(err).Msg("could not read Chart.yaml")
+	}
 
-	err := filepath.Walk(templatesPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	// Template paths are reported relative to the chart parent, as the helm engine does
+	err := scanChartDirectory(chartPath, filepath.Dir(chartPath), annotationLabels, results)
+
+	declared := newDeclaredResults(annotationLabels)
+	declared.collectDirectory(chartPath, filepath.Dir(chartPath), annotationLabels)
+	declared.mergeInto(results)
+
+	results.logCounts()
+	return results, err
+}
 
-		if !info.IsDir() {
-			ext := filepath.Ext(path)
-			if ext == ".yaml" || ext == ".yml" || ext == ".tpl" {
-				if resources, err := ProcessTemplateFile(path, annotationLabel, chartPath); err == nil {
-					for _, resource := range resources {
-						resourceMap[resource]++
+// loadChartValues loads the values.yaml and Chart.yaml of the chart in chartPath, once for all its templates.
+// It returns nil if the values cannot be loaded, the templates of the annotations are then not evaluated
+func loadChartValues(chartPath string) *ValuesFile {
+	values, err := LoadValuesFile(chartPath)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed to load values.yaml of %s, templates cannot be evaluated", filepath.Base(chartPath))
+		return nil
+	}
+	if metadata, err := loadChartMetadata(chartPath); err == nil {
+		values.Chart = metadata
+	}
+	return values
+}
+
+// scanChartDirectory scans the templates of the chart in chartPath, then recurses in its subcharts
+func scanChartDirectory(chartPath, basePath string, annotationLabels []string, results ProcessResults) error {
+	templatesPath := filepath.Join(chartPath, "templates")
+	if _, err := os.Stat(templatesPath); err == nil {
+		values := loadChartValues(chartPath)
+		err := filepath.Walk(templatesPath, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !info.IsDir() {
+				ext := filepath.Ext(path)
+				if ext == ".yaml" || ext == ".yml" || ext == ".tpl" {
+					if manifestsByLabel, err := ProcessTemplateFile(path, annotationLabels, values); err == nil {
+						template, err := filepath.Rel(basePath, path)
+						if err != nil {
+							template = path
+						}
+						for annotationLabel, manifests := range manifestsByLabel {
+							for _, manifest := range manifests {
+								results[annotationLabel].add(filepath.ToSlash(template), manifest)
+							}
+						}
+					} else {
+						log.Error().Err(err).Msgf("Error processing %s", filepath.Base(path))
 					}
-				} else {
-					log.Error().Err(err).Msgf("Error processing %s", filepath.Base(path))
 				}
 			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
+	}
+
+	subcharts, err := os.ReadDir(filepath.Join(chartPath, "charts"))
+	if err != nil {
 		return nil
-	})
+	}
+	for _, subchart := range subcharts {
+		subchartPath := filepath.Join(chartPath, "charts", subchart.Name())
+		if !subchart.IsDir() {
+			log.Warn().Msgf("skipping packaged subchart %s, it can only be scanned if the chart can be loaded", subchart.Name())
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(subchartPath, "Chart.yaml")); err != nil {
+			continue
+		}
+		if err := scanChartDirectory(subchartPath, basePath, annotationLabels, results); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	for key := range resourceMap {
-		log.Debug().Msgf("key: %s, value: %d", key, resourceMap[key])
+// loadChartMetadata reads the Chart.yaml file of the chart
+func loadChartMetadata(chartPath string) (*helmchart.Metadata, error) {
+	content, err := os.ReadFile(filepath.Join(chartPath, "Chart.yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading Chart.yaml: %w", err)
 	}
-	return resourceMap, err
+
+	// Chart.yaml keys follow the json tags of the metadata
+	metadata := &helmchart.Metadata{}
+	if err := sigsyaml.Unmarshal(content, metadata); err != nil {
+		return nil, fmt.Errorf("error parsing Chart.yaml: %w", err)
+	}
+	return metadata, nil
 }
 
 // CleanupDirectory removes a directory and all its contents
 func CleanupDirectory(directory string) error {
+	if directory == "" {
+		return fmt.Errorf("refusing to cleanup an empty directory path")
+	}
 	if _, err := os.Stat(directory); !os.IsNotExist(err) {
 		log.Debug().Msgf("Cleaning up directory: %s", directory)
 		if err := os.RemoveAll(directory); err != nil {
@@ -0,0 +1,58 @@
+package chart
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindChartRoot(t *testing.T) {
+	dir := t.TempDir()
+	for _, file := range []string{
+		"a/charts/dependency/Chart.yaml",
+		"fireworks-app/Chart.yaml",
+		"fireworks-app/charts/dependency/Chart.yaml",
+		"fireworks-app/templates/deployment.yaml",
+	} {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("name: chart\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The dependency walked first is deeper than the chart itself
+	root, err := FindChartRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != filepath.Join(dir, "fireworks-app") {
+		t.Fatalf("expected the shallowest Chart.yaml, got %s", root)
+	}
+
+	if _, err := FindChartRoot(filepath.Join(dir, "fireworks-app", "templates")); err == nil {
+		t.Fatal("expected an error without Chart.yaml")
+	}
+}
+
+func TestCleanupDirectory(t *testing.T) {
+	if err := CleanupDirectory(""); err == nil {
+		t.Fatal("expected an error for an empty directory path")
+	}
+
+	dir := filepath.Join(t.TempDir(), "chart")
+	if err := os.MkdirAll(filepath.Join(dir, "templates"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := CleanupDirectory(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed", dir)
+	}
+	if err := CleanupDirectory(dir); err != nil {
+		t.Fatalf("expected no error for a missing directory, got %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package chart
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+	"helm.sh/helm/v3/pkg/chartutil"
+
+	helmchart "helm.sh/helm/v3/pkg/chart"
+)
+
+// Sources of the finops resources, from the highest to the lowest precedence. A resource found in the
+// templates ignores the declarations in values.yaml and Chart.yaml, and a resource declared in values.yaml
+// ignores the one in Chart.yaml
+const (
+	SourceTemplate = "template"
+	SourceValues   = "values"
+	SourceChart    = "chart"
+)
+
+// FinopsValuesKey is the values.yaml block mapping each annotation label to the resources of the chart,
+// in any of the formats accepted by the annotations
+const FinopsValuesKey = "finops"
+
+// declaredResults collects the finops resources declared outside of the templates, by source
+type declaredResults struct {
+	values ProcessResults
+	chart  ProcessResults
+}
+
+func newDeclaredResults(annotationLabels []string) *declaredResults {
+	return &declaredResults{
+		values: newProcessResults(annotationLabels),
+		chart:  newProcessResults(annotationLabels),
+	}
+}
+
+// collect reads the resources declared in the finops block of the values and in the Chart.yaml annotations
+// of a single chart. chartPath is the path of the chart as reported in the provenance
+func (d *declaredResults) collect(chartPath string, metadata *helmchart.Metadata, values map[string]interface{}, annotationLabels []string) {
+	valuesFile := &ValuesFile{Values: values, Chart: metadata}
+	if valuesFile.Values == nil {
+		valuesFile.Values = map[string]interface{}{}
+	}
+
+	finops, _ := valuesFile.Values[FinopsValuesKey].(map[string]interface{})
+	for _, annotationLabel := range annotationLabels {
+		declared, ok := finops[annotationLabel]
+		if !ok || declared == nil {
+			continue
+		}
+		value, ok := declared.(string)
+		if !ok {
+			encoded, err := json.Marshal(declared)
+			if err != nil {
+				log.Error().Err(err).Msgf("Error encoding %s.%s of %s", FinopsValuesKey, annotationLabel, chartPath)
+				continue
+			}
+			value = string(encoded)
+		}
+		d.values[annotationLabel].addDeclared(SourceValues, path.Join(chartPath, "values.yaml"), value, valuesFile)
+	}
+
+	if metadata == nil {
+		return
+	}
+	for _, annotationLabel := range annotationLabels {
+		if value, ok := metadata.Annotations[annotationLabel]; ok {
+			d.chart[annotationLabel].addDeclared(SourceChart, path.Join(chartPath, "Chart.yaml"), value, valuesFile)
+		}
+	}
+}
+
+// collectLoaded collects the declared resources of an in-memory chart and of its subcharts. values are the
+// values of the chart, the ones of each subchart are read from the block named after it, as helm scopes them
+func (d *declaredResults) collectLoaded(chrt *helmchart.Chart, values map[string]interface{}, annotationLabels []string) {
+	d.collect(chrt.ChartFullPath(), chrt.Metadata, values, annotationLabels)
+
+	dependencies := make([]*helmchart.Chart, len(chrt.Dependencies()))
+	copy(dependencies, chrt.Dependencies())
+	sort.Slice(dependencies, func(i, j int) bool { return dependencies[i].Name() < dependencies[j].Name() })
+	for _, dependency := range dependencies {
+		dependencyValues, _ := values[dependency.Name()].(map[string]interface{})
+		d.collectLoaded(dependency, dependencyValues, annotationLabels)
+	}
+}
+
+// collectDirectory collects the declared resources of the chart in chartPath and of the subcharts unpacked
+// in its charts directory, each with its own values.yaml
+func (d *declaredResults) collectDirectory(chartPath, basePath string, annotationLabels []string) {
+	metadata, _ := loadChartMetadata(chartPath)
+	var values map[string]interface{}
+	if valuesFile, err := LoadValuesFile(chartPath); err == nil {
+		values = valuesFile.Values
+	}
+
+	displayPath, err := filepath.Rel(basePath, chartPath)
+	if err != nil {
+		displayPath = chartPath
+	}
+	d.collect(filepath.ToSlash(displayPath), metadata, values, annotationLabels)
+
+	subcharts, err := os.ReadDir(filepath.Join(chartPath, "charts"))
+	if err != nil {
+		return
+	}
+	for _, subchart := range subcharts {
+		subchartPath := filepath.Join(chartPath, "charts", subchart.Name())
+		if !subchart.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(subchartPath, "Chart.yaml")); err != nil {
+			continue
+		}
+		d.collectDirectory(subchartPath, basePath, annotationLabels)
+	}
+}
+
+// mergeInto adds the declared resources to the resources found in the templates, following the precedence
+// of the sources
+func (d *declaredResults) mergeInto(results ProcessResults) {
+	for annotationLabel, result := range results {
+		result.mergeDeclared(d.values[annotationLabel])
+		result.mergeDeclared(d.chart[annotationLabel])
+	}
+}
+
+// addDeclaredResources merges the resources declared in the values and Chart.yaml of an in-memory chart and
+// of its subcharts into results. The given values are coalesced with the chart defaults, as the engine does
+func addDeclaredResources(chrt *helmchart.Chart, values map[string]interface{}, annotationLabels []string, results ProcessResults) {
+	coalesced, err := chartutil.CoalesceValues(chrt, values)
+	if err != nil {
+		log.Warn().Err(err).Msg("could not coalesce chart values, reading the finops block of the chart defaults")
+		coalesced = chrt.Values
+	}
+
+	declared := newDeclaredResults(annotationLabels)
+	declared.collectLoaded(chrt, coalesced, annotationLabels)
+	declared.mergeInto(results)
+}
@@ -0,0 +1,122 @@
+package chart
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessHelmTemplatesDeclaredResources(t *testing.T) {
+	const label = "krateo-finops-focus-resource"
+
+	chartPath := filepath.Join(t.TempDir(), "parent")
+	writeChartFiles(t, chartPath, map[string]string{
+		"Chart.yaml": `apiVersion: v2
+name: parent
+version: 1.0.0
+annotations:
+  krateo-finops-focus-resource: '["Storage", "Network", "Backup"]'
+`,
+		"values.yaml": `sku: Standard_B1s
+finops:
+  krateo-finops-focus-resource:
+    - Storage
+    - resource: Network
+      quantity: 3
+    - "{{ .Values.sku }}"
+`,
+		"templates/cm.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: parent
+  annotations:
+    krateo-finops-focus-resource: '["Storage", "Storage"]'
+`,
+	})
+
+	results, err := ProcessHelmTemplates(chartPath, []string{label}, ProcessOptions{
+		Values: map[string]interface{}{"sku": "Premium_LRS"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := results[label]
+
+	want := map[string]struct {
+		count  float64
+		source string
+	}{
+		"Storage":     {2, SourceTemplate},
+		"Network":     {3, SourceValues},
+		"Premium_LRS": {1, SourceValues},
+		"Backup":      {1, SourceChart},
+	}
+	if len(result.Counts) != len(want) {
+		t.Fatalf("unexpected counts: %v", result.Counts)
+	}
+	for key, expected := range want {
+		if result.Counts[key] != expected.count || result.Sources[key] != expected.source {
+			t.Fatalf("expected %s to count %g from %s, got %g from %s", key, expected.count, expected.source, result.Counts[key], result.Sources[key])
+		}
+	}
+
+	provenance := result.Provenance["Backup"]
+	if len(provenance) != 1 || provenance[0].Template != "parent/Chart.yaml" || provenance[0].Chart != "parent" || provenance[0].Source != SourceChart {
+		t.Fatalf("unexpected provenance for Backup: %+v", provenance)
+	}
+
+	// Resources counted once without a unit are stored as before the quantities, as integers without a quantity
+	if provenance := result.Provenance["Storage"]; len(provenance) != 2 || provenance[0].Quantity != nil || provenance[1].Quantity != nil {
+		t.Fatalf("unexpected provenance for Storage: %+v", provenance)
+	}
+	if provenance := result.Provenance["Network"]; len(provenance) != 1 || provenance[0].Quantity == nil || *provenance[0].Quantity != 3 {
+		t.Fatalf("unexpected provenance for Network: %+v", provenance)
+	}
+	encoded, err := json.Marshal(result.Counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(encoded) != `{"Backup":1,"Network":3,"Premium_LRS":1,"Storage":2}` {
+		t.Fatalf("unexpected encoded counts: %s", encoded)
+	}
+}
+
+func TestProcessHelmTemplatesDeclaredErrors(t *testing.T) {
+	const label = "krateo-finops-focus-resource"
+
+	chartPath := filepath.Join(t.TempDir(), "parent")
+	writeChartFiles(t, chartPath, map[string]string{
+		"Chart.yaml": `apiVersion: v2
+name: parent
+version: 1.0.0
+`,
+		"values.yaml": `finops:
+  krateo-finops-focus-resource:
+    - resource: Storage
+      quantity: "{{ .Values.missing.size }}"
+    - resource: Disk
+      quantity: "{{ .Values.missing.size }}"
+`,
+		"templates/cm.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: parent
+  annotations:
+    krateo-finops-focus-resource: '["Storage"]'
+`,
+	})
+
+	results, err := ProcessHelmTemplates(chartPath, []string{label}, ProcessOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := results[label]
+
+	// Storage is found in the templates, the error of its declaration in values.yaml is ignored with it
+	if len(result.Counts) != 1 || result.Counts["Storage"] != 1 {
+		t.Fatalf("unexpected counts: %v", result.Counts)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Resource != "Disk" || result.Errors[0].Source != SourceValues {
+		t.Fatalf("expected only the error of Disk, got %+v", result.Errors)
+	}
+}
@@ -0,0 +1,115 @@
+package chart
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	helmchart "helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+
+	getter "finops-composition-definition-parser/internal/helpers/chart/getter"
+)
+
+// ProcessOptions tunes how a chart is processed
+type ProcessOptions struct {
+	// Values are merged with the chart default values before rendering
+	Values map[string]interface{}
+	// ReleaseName and ReleaseNamespace are used to render the chart, they default to the chart name and "default"
+	ReleaseName      string
+	ReleaseNamespace string
+	// FetchDependencies downloads the dependencies declared in Chart.yaml that are not vendored in the charts directory
+	FetchDependencies bool
+	// ExtractLimits bound the archives of the fetched dependencies
+	ExtractLimits ExtractLimits
+	// Repository is the repository of the chart. Its TLS setting is used to fetch all the dependencies, and its
+	// credentials only for the dependencies on the same host, as helm does
+	Repository ChartRepository
+}
+
+// fetchMissingDependencies downloads the dependencies declared in the chart metadata that are not
+// vendored in the chart, and adds them to the chart. Local and aliased repositories cannot be
+// resolved and are skipped
+func fetchMissingDependencies(chrt *helmchart.Chart, opts ProcessOptions) {
+	if chrt.Metadata == nil {
+		return
+	}
+
+	vendored := map[string]bool{}
+	for _, dependency := range chrt.Dependencies() {
+		vendored[dependency.Name()] = true
+	}
+
+	for _, dependency := range chrt.Metadata.Dependencies {
+		if dependency == nil || vendored[dependency.Name] {
+			continue
+		}
+		if dependency.Repository == "" || strings.HasPrefix(dependency.Repository, "file://") || strings.HasPrefix(dependency.Repository, "@") {
+			log.Warn().Msgf("dependency %s of chart %s is not vendored and its repository %q cannot be fetched", dependency.Name, chrt.Name(), dependency.Repository)
+			continue
+		}
+
+		log.Debug().Msgf("fetching dependency %s %s from %s", dependency.Name, dependency.Version, dependency.Repository)
+		getOptions := getter.GetOptions{
+			URI:                   dependency.Repository,
+			Repo:                  dependency.Name,
+			Version:               dependency.Version,
+			InsecureSkipVerifyTLS: opts.Repository.InsecureSkipVerifyTLS,
+		}
+		if opts.Repository.Username != "" {
+			if sameHost(opts.Repository.URL, dependency.Repository) {
+				getOptions.Username = opts.Repository.Username
+				getOptions.Password = opts.Repository.Password
+				getOptions.PassCredentialsAll = true
+			} else {
+				log.Warn().Msgf("the credentials of chart %s are not used for its dependency %s, hosted on %s", chrt.Name(), dependency.Name, dependency.Repository)
+			}
+		}
+		dat, _, err := getter.Get(getOptions)
+		if err != nil {
+			log.Error().Err(err).Msgf("error fetching dependency %s of chart %s", dependency.Name, chrt.Name())
+			continue
+		}
+		if err := checkTgz(dat, opts.ExtractLimits); err != nil {
+			log.Error().Err(err).Msgf("error checking dependency %s of chart %s", dependency.Name, chrt.Name())
+			continue
+		}
+
+		subchart, err := loader.LoadArchive(bytes.NewReader(dat))
+		if err != nil {
+			log.Error().Err(err).Msgf("error loading dependency %s of chart %s", dependency.Name, chrt.Name())
+			continue
+		}
+		chrt.AddDependency(subchart)
+		vendored[dependency.Name] = true
+	}
+}
+
+// sameHost reports whether both URLs have the same host and port
+func sameHost(a, b string) bool {
+	urlA, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	urlB, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return urlA.Host != "" && urlA.Host == urlB.Host
+}
+
+// processDependencies enables or disables the subcharts according to the conditions and tags of the
+// chart dependencies, and applies their aliases, as helm does before rendering
+func processDependencies(chrt *helmchart.Chart, values map[string]interface{}) error {
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	if err := chartutil.ProcessDependenciesWithMerge(chrt, values); err != nil {
+		return fmt.Errorf("error processing chart dependencies: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package chart
+
+import (
+	"archive/tar"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	helmchart "helm.sh/helm/v3/pkg/chart"
+)
+
+func writeChartFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		target := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(target, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestProcessHelmTemplatesSubcharts(t *testing.T) {
+	const (
+		label       = "krateo-finops-focus-resource"
+		carbonLabel = "krateo-finops-carbon-resource"
+	)
+
+	chartPath := filepath.Join(t.TempDir(), "parent")
+	writeChartFiles(t, chartPath, map[string]string{
+		"Chart.yaml": `apiVersion: v2
+name: parent
+version: 1.0.0
+dependencies:
+  - name: redis
+    version: 1.0.0
+  - name: disabled
+    version: 1.0.0
+    condition: disabled.enabled
+`,
+		"values.yaml": "disabled:\n  enabled: false\n",
+		"templates/cm.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: parent
+  annotations:
+    krateo-finops-focus-resource: '["Storage"]'
+    krateo-finops-carbon-resource: '["StorageEnergy"]'
+`,
+		"charts/redis/Chart.yaml":  "apiVersion: v2\nname: redis\nversion: 1.0.0\n",
+		"charts/redis/values.yaml": "sku: Standard_B1s\n",
+		"charts/redis/templates/deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: redis
+  annotations:
+    krateo-finops-focus-resource: '["{{ .Values.sku }}"]'
+`,
+		"charts/disabled/Chart.yaml": "apiVersion: v2\nname: disabled\nversion: 1.0.0\n",
+		"charts/disabled/templates/cm.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: disabled
+  annotations:
+    krateo-finops-focus-resource: '["Disabled"]'
+`,
+	})
+
+	results, err := ProcessHelmTemplates(chartPath, []string{label, carbonLabel}, ProcessOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := results[label]
+
+	if len(result.Counts) != 2 || result.Counts["Storage"] != 1 || result.Counts["Standard_B1s"] != 1 {
+		t.Fatalf("unexpected counts: %v", result.Counts)
+	}
+
+	provenance := result.Provenance["Standard_B1s"]
+	if len(provenance) != 1 || provenance[0].Chart != "redis" || provenance[0].Template != "parent/charts/redis/templates/deployment.yaml" {
+		t.Fatalf("unexpected provenance for the subchart resource: %v", provenance)
+	}
+	if provenance := result.Provenance["Storage"]; len(provenance) != 1 || provenance[0].Chart != "parent" {
+		t.Fatalf("unexpected provenance for the parent resource: %v", provenance)
+	}
+
+	// Each label is extracted independently from the same rendering
+	if carbon := results[carbonLabel]; len(carbon.Counts) != 1 || carbon.Counts["StorageEnergy"] != 1 || carbon.ChartVersion != "1.0.0" {
+		t.Fatalf("unexpected carbon result: %v", carbon)
+	}
+
+	// The raw scan cannot evaluate the conditions, but must still walk the subcharts
+	scannedResults, err := ScanHelmTemplates(chartPath, []string{label, carbonLabel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanned := scannedResults[label]
+	if scanned.Counts["Standard_B1s"] != 1 || scanned.Counts["Disabled"] != 1 {
+		t.Fatalf("unexpected scanned counts: %v", scanned.Counts)
+	}
+	if provenance := scanned.Provenance["Standard_B1s"]; len(provenance) != 1 || provenance[0].Template != "parent/charts/redis/templates/deployment.yaml" {
+		t.Fatalf("unexpected scanned provenance: %v", provenance)
+	}
+	if carbon := scannedResults[carbonLabel]; len(carbon.Counts) != 1 || carbon.Counts["StorageEnergy"] != 1 {
+		t.Fatalf("unexpected scanned carbon counts: %v", carbon.Counts)
+	}
+}
+
+func TestFetchMissingDependencies(t *testing.T) {
+	dependency := buildTgz(t, []tarEntry{
+		{header: tar.Header{Name: "big/Chart.yaml", Typeflag: tar.TypeReg}, content: "apiVersion: v2\nname: big\nversion: 1.0.0\n"},
+		{header: tar.Header{Name: "big/templates/cm.yaml", Typeflag: tar.TypeReg}, content: strings.Repeat("# padding\n", 100)},
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The dependency is hosted with the chart, the credentials of the chart are needed
+		if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/index.yaml":
+			w.Write([]byte("apiVersion: v1\nentries:\n  big:\n    - name: big\n      version: 1.0.0\n      urls: [big-1.0.0.tgz]\n"))
+		case "/big-1.0.0.tgz":
+			w.Write(dependency)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	parent := func() *helmchart.Chart {
+		return &helmchart.Chart{Metadata: &helmchart.Metadata{
+			APIVersion:   "v2",
+			Name:         "parent",
+			Version:      "1.0.0",
+			Dependencies: []*helmchart.Dependency{{Name: "big", Version: "1.0.0", Repository: server.URL}},
+		}}
+	}
+	repository := ChartRepository{URL: server.URL + "/parent-1.0.0.tgz", Username: "user", Password: "pass"}
+
+	chrt := parent()
+	fetchMissingDependencies(chrt, ProcessOptions{ExtractLimits: DefaultExtractLimits, Repository: repository})
+	if len(chrt.Dependencies()) != 1 || chrt.Dependencies()[0].Name() != "big" {
+		t.Fatalf("expected the dependency to be fetched, got %v", chrt.Dependencies())
+	}
+
+	// The dependency archive exceeds the limits
+	chrt = parent()
+	fetchMissingDependencies(chrt, ProcessOptions{ExtractLimits: ExtractLimits{MaxFileSize: 100, MaxTotalSize: 1000, MaxFiles: 10}, Repository: repository})
+	if len(chrt.Dependencies()) != 0 {
+		t.Fatal("expected the oversized dependency to be rejected")
+	}
+
+	// The credentials are not sent to another host
+	chrt = parent()
+	repository.URL = "https://charts.example.com/parent-1.0.0.tgz"
+	fetchMissingDependencies(chrt, ProcessOptions{ExtractLimits: DefaultExtractLimits, Repository: repository})
+	if len(chrt.Dependencies()) != 0 {
+		t.Fatal("expected the dependency to be fetched without credentials")
+	}
+}
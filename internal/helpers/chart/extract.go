@@ -0,0 +1,192 @@
+package chart
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ExtractLimits bounds what an archive may contain when it is extracted
+type ExtractLimits struct {
+	// MaxFileSize is the maximum uncompressed size of a single file, in bytes
+	MaxFileSize int64
+	// MaxTotalSize is the maximum uncompressed size of all the files, in bytes
+	MaxTotalSize int64
+	// MaxFiles is the maximum number of entries in the archive
+	MaxFiles int
+}
+
+// DefaultExtractLimits are large enough for any reasonable chart
+var DefaultExtractLimits = ExtractLimits{
+	MaxFileSize:  5 * 1024 * 1024,
+	MaxTotalSize: 100 * 1024 * 1024,
+	MaxFiles:     10000,
+}
+
+// ExtractTgz extracts a tgz archive in extractPath. Entries escaping extractPath, links and special files
+// are rejected, regular files are created with fixed permissions and the limits are enforced on the
+// uncompressed content
+func ExtractTgz(tgz []byte, extractPath string, limits ExtractLimits) error {
+	gzr, err := gzip.NewReader(bytes.NewReader(tgz))
+	if err != nil {
+		return fmt.Errorf("error creating gzip reader: %v", err)
+	}
+	defer gzr.Close()
+
+	destination, err := filepath.Abs(extractPath)
+	if err != nil {
+		return fmt.Errorf("error resolving extract path: %v", err)
+	}
+
+	tr := tar.NewReader(gzr)
+
+	log.Debug().Msgf("Extracting to %s...", destination)
+	var totalSize int64
+	files := 0
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading tar: %v", err)
+		}
+
+		files++
+		if limits.MaxFiles > 0 && files > limits.MaxFiles {
+			return fmt.Errorf("archive contains more than %d entries", limits.MaxFiles)
+		}
+
+		target, err := safeJoin(destination, header.Name)
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("error creating directory: path %s - err %v", target, err)
+			}
+		case tar.TypeReg:
+			if limits.MaxFileSize > 0 && header.Size > limits.MaxFileSize {
+				return fmt.Errorf("entry %s exceeds the maximum file size of %d bytes", header.Name, limits.MaxFileSize)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("error creating directory: path %s - err %v", filepath.Dir(target), err)
+			}
+
+			written, err := extractFile(tr, target, limits.MaxFileSize)
+			if err != nil {
+				return fmt.Errorf("error extracting %s: %v", header.Name, err)
+			}
+			totalSize += written
+			if limits.MaxTotalSize > 0 && totalSize > limits.MaxTotalSize {
+				return fmt.Errorf("archive exceeds the maximum total size of %d bytes", limits.MaxTotalSize)
+			}
+		case tar.TypeSymlink, tar.TypeLink:
+			return fmt.Errorf("entry %s is a link, links are not allowed", header.Name)
+		case tar.TypeXGlobalHeader, tar.TypeXHeader:
+			// Metadata only, already handled by the tar reader
+			continue
+		default:
+			return fmt.Errorf("entry %s has unsupported type %q", header.Name, header.Typeflag)
+		}
+	}
+
+	log.Debug().Msg("Download and extraction completed successfully!")
+	return nil
+}
+
+// checkTgz enforces the limits on a tgz archive without extracting it, for the archives loaded in memory, which
+// the helm loader decompresses entirely
+func checkTgz(tgz []byte, limits ExtractLimits) error {
+	gzr, err := gzip.NewReader(bytes.NewReader(tgz))
+	if err != nil {
+		return fmt.Errorf("error creating gzip reader: %v", err)
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	var totalSize int64
+	files := 0
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading tar: %v", err)
+		}
+
+		files++
+		if limits.MaxFiles > 0 && files > limits.MaxFiles {
+			return fmt.Errorf("archive contains more than %d entries", limits.MaxFiles)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if limits.MaxFileSize > 0 && header.Size > limits.MaxFileSize {
+			return fmt.Errorf("entry %s exceeds the maximum file size of %d bytes", header.Name, limits.MaxFileSize)
+		}
+
+		// The header size cannot be trusted, count the content as well
+		var r io.Reader = tr
+		if limits.MaxFileSize > 0 {
+			r = io.LimitReader(r, limits.MaxFileSize+1)
+		}
+		read, err := io.Copy(io.Discard, r)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", header.Name, err)
+		}
+		if limits.MaxFileSize > 0 && read > limits.MaxFileSize {
+			return fmt.Errorf("entry %s exceeds the maximum file size of %d bytes", header.Name, limits.MaxFileSize)
+		}
+		totalSize += read
+		if limits.MaxTotalSize > 0 && totalSize > limits.MaxTotalSize {
+			return fmt.Errorf("archive exceeds the maximum total size of %d bytes", limits.MaxTotalSize)
+		}
+	}
+}
+
+// safeJoin joins the name of an archive entry to the destination, rejecting names that escape it
+func safeJoin(destination, name string) (string, error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) {
+		return "", fmt.Errorf("entry %s has an absolute path", name)
+	}
+
+	target := filepath.Join(destination, name)
+	if target != destination && !strings.HasPrefix(target, destination+string(os.PathSeparator)) {
+		return "", fmt.Errorf("entry %s escapes the extract path", name)
+	}
+	return target, nil
+}
+
+// extractFile copies a single entry to the target file, closing it before returning
+func extractFile(r io.Reader, target string, maxFileSize int64) (int64, error) {
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("error creating file: %v", err)
+	}
+	defer file.Close()
+
+	if maxFileSize > 0 {
+		r = io.LimitReader(r, maxFileSize+1)
+	}
+	written, err := io.Copy(file, r)
+	if err != nil {
+		return written, fmt.Errorf("error copying file contents: %v", err)
+	}
+	if maxFileSize > 0 && written > maxFileSize {
+		return written, fmt.Errorf("file exceeds the maximum file size of %d bytes", maxFileSize)
+	}
+
+	return written, file.Close()
+}
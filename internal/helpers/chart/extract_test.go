@@ -0,0 +1,172 @@
+package chart
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type tarEntry struct {
+	header  tar.Header
+	content string
+}
+
+func buildTgz(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	gzw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gzw)
+	for _, entry := range entries {
+		header := entry.header
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(entry.content))
+		}
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if entry.content != "" {
+			if _, err := tw.Write([]byte(entry.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractTgz(t *testing.T) {
+	tgz := buildTgz(t, []tarEntry{
+		{header: tar.Header{Name: "mychart/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "mychart/Chart.yaml", Typeflag: tar.TypeReg, Mode: 04777}, content: "name: mychart\n"},
+		{header: tar.Header{Name: "mychart/templates/cm.yaml", Typeflag: tar.TypeReg}, content: "kind: ConfigMap\n"},
+	})
+
+	extractPath := t.TempDir()
+	if err := ExtractTgz(tgz, extractPath, DefaultExtractLimits); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(extractPath, "mychart", "Chart.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 || info.Mode()&os.ModeSetuid != 0 {
+		t.Fatalf("expected the header mode to be ignored, got %v", info.Mode())
+	}
+
+	root, err := FindChartRoot(extractPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != filepath.Join(extractPath, "mychart") {
+		t.Fatalf("unexpected chart root %s", root)
+	}
+}
+
+func TestExtractTgzRejectsMaliciousArchives(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		limits  ExtractLimits
+		want    string
+	}{
+		{
+			name:    "path traversal",
+			entries: []tarEntry{{header: tar.Header{Name: "mychart/../../evil.yaml", Typeflag: tar.TypeReg}, content: "evil"}},
+			limits:  DefaultExtractLimits,
+			want:    "escapes the extract path",
+		},
+		{
+			name:    "absolute path",
+			entries: []tarEntry{{header: tar.Header{Name: "/tmp/evil.yaml", Typeflag: tar.TypeReg}, content: "evil"}},
+			limits:  DefaultExtractLimits,
+			want:    "absolute path",
+		},
+		{
+			name:    "symlink",
+			entries: []tarEntry{{header: tar.Header{Name: "mychart/link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}}},
+			limits:  DefaultExtractLimits,
+			want:    "links are not allowed",
+		},
+		{
+			name:    "hardlink",
+			entries: []tarEntry{{header: tar.Header{Name: "mychart/link", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"}}},
+			limits:  DefaultExtractLimits,
+			want:    "links are not allowed",
+		},
+		{
+			name:    "device",
+			entries: []tarEntry{{header: tar.Header{Name: "mychart/dev", Typeflag: tar.TypeChar}}},
+			limits:  DefaultExtractLimits,
+			want:    "unsupported type",
+		},
+		{
+			name:    "file too large",
+			entries: []tarEntry{{header: tar.Header{Name: "mychart/big.yaml", Typeflag: tar.TypeReg}, content: strings.Repeat("a", 11)}},
+			limits:  ExtractLimits{MaxFileSize: 10, MaxTotalSize: 100, MaxFiles: 10},
+			want:    "maximum file size",
+		},
+		{
+			name: "total too large",
+			entries: []tarEntry{
+				{header: tar.Header{Name: "mychart/a.yaml", Typeflag: tar.TypeReg}, content: strings.Repeat("a", 8)},
+				{header: tar.Header{Name: "mychart/b.yaml", Typeflag: tar.TypeReg}, content: strings.Repeat("b", 8)},
+			},
+			limits: ExtractLimits{MaxFileSize: 10, MaxTotalSize: 15, MaxFiles: 10},
+			want:   "maximum total size",
+		},
+		{
+			name: "too many files",
+			entries: []tarEntry{
+				{header: tar.Header{Name: "mychart/a.yaml", Typeflag: tar.TypeReg}, content: "a"},
+				{header: tar.Header{Name: "mychart/b.yaml", Typeflag: tar.TypeReg}, content: "b"},
+				{header: tar.Header{Name: "mychart/c.yaml", Typeflag: tar.TypeReg}, content: "c"},
+			},
+			limits: ExtractLimits{MaxFileSize: 10, MaxTotalSize: 100, MaxFiles: 2},
+			want:   "more than 2 entries",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			extractPath := filepath.Join(parent, "extract")
+			if err := os.Mkdir(extractPath, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			tgz := buildTgz(t, tt.entries)
+			err := ExtractTgz(tgz, extractPath, tt.limits)
+			if err == nil {
+				t.Fatal("expected the archive to be rejected")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected error containing %q, got %v", tt.want, err)
+			}
+
+			// The limits apply to the archives loaded in memory as well
+			if strings.Contains(tt.want, "maximum") || strings.Contains(tt.want, "entries") {
+				if err := checkTgz(tgz, tt.limits); err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Fatalf("expected the in-memory check to fail with %q, got %v", tt.want, err)
+				}
+			}
+
+			if _, err := os.Stat(filepath.Join(parent, "evil.yaml")); !os.IsNotExist(err) {
+				t.Fatal("file written outside of the extract path")
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package chart
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+
+	helmchart "helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+
+	coreprovider "github.com/krateoplatformops/core-provider/apis/compositiondefinitions/v1alpha1"
+
+	secretsHelper "finops-composition-definition-parser/internal/helpers/kube/secrets"
+)
+
+// ChartArchiveFromSpec downloads the chart archive, so that it can be loaded more than once with LoadChartArchive.
+// The archive is checked against the same limits as the extracted ones, since loading it decompresses it in memory,
+// and the downloaded archive cannot exceed the maximum total size either. The getters read the whole download
+// before it can be checked
+func ChartArchiveFromSpec(nfo *coreprovider.ChartInfo, limits ExtractLimits, secrets *secretsHelper.Accessor) ([]byte, error) {
+	dat, err := fetchChart(nfo, secrets)
+	if err != nil {
+		return nil, err
+	}
+	if limits.MaxTotalSize > 0 && int64(len(dat)) > limits.MaxTotalSize {
+		return nil, fmt.Errorf("chart archive exceeds the maximum total size of %d bytes", limits.MaxTotalSize)
+	}
+	if err := checkTgz(dat, limits); err != nil {
+		return nil, err
+	}
+	return dat, nil
+}
+
+// LoadChartArchive loads a chart archive in memory. Processing a chart alters its dependencies and values,
+// so each processing needs its own loaded chart
+func LoadChartArchive(dat []byte) (*helmchart.Chart, error) {
+	chrt, err := loader.LoadArchive(bytes.NewReader(dat))
+	if err != nil {
+		return nil, fmt.Errorf("error loading chart archive: %w", err)
+	}
+	return chrt, nil
+}
+
+// ProcessLoadedChart renders an in-memory chart and its subcharts with the helm engine, using the chart
+// defaults merged with the given values, and collects the finops resources from the annotations of the
+// rendered manifests. If the chart cannot be rendered, it falls back to scanning the raw templates of the
+// chart and of its subcharts. The resources declared in the finops block of the values and in the Chart.yaml
+// annotations are added for the resources not found in the templates
+func ProcessLoadedChart(chrt *helmchart.Chart, annotationLabels []string, opts ProcessOptions) (ProcessResults, error) {
+	if opts.FetchDependencies {
+		fetchMissingDependencies(chrt, opts)
+	}
+	if err := processDependencies(chrt, opts.Values); err != nil {
+		log.Warn().Err(err).Msg("could not process chart dependencies, all the vendored subcharts are processed")
+	}
+
+	results, err := processRenderedChart(chrt, annotationLabels, opts)
+	if err != nil {
+		log.Warn().Err(err).Msg("could not render chart, falling back to template scanning")
+		results = scanLoadedTemplates(chrt, annotationLabels)
+	}
+
+	addDeclaredResources(chrt, opts.Values, annotationLabels, results)
+	results.logCounts()
+	return results, nil
+}
+
+// scanLoadedTemplates scans the raw templates of an in-memory chart and of its subcharts
+func scanLoadedTemplates(chrt *helmchart.Chart, annotationLabels []string) ProcessResults {
+	results := newProcessResults(annotationLabels)
+	if chrt.Metadata != nil {
+		results.setChartVersion(chrt.Metadata.Version)
+	}
+
+	scanLoadedChart(chrt, annotationLabels, results)
+	return results
+}
+
+// scanLoadedChart scans the templates of the chart with its own values, then recurses in its subcharts
+func scanLoadedChart(chrt *helmchart.Chart, annotationLabels []string, results ProcessResults) {
+	values := &ValuesFile{Values: chrt.Values, Chart: chrt.Metadata}
+	if values.Values == nil {
+		values.Values = map[string]interface{}{}
+	}
+
+	templates := make([]*helmchart.File, len(chrt.Templates))
+	copy(templates, chrt.Templates)
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+
+	for _, file := range templates {
+		ext := path.Ext(file.Name)
+		if ext != ".yaml" && ext != ".yml" && ext != ".tpl" {
+			continue
+		}
+
+		log.Debug().Msgf("Processing %s:", path.Base(file.Name))
+		// Template paths are reported as the helm engine does
+		template := path.Join(chrt.ChartFullPath(), file.Name)
+		for _, annotationLabel := range annotationLabels {
+			manifests, err := ExtractManifestResources(string(file.Data), annotationLabel, values)
+			if err != nil {
+				log.Error().Err(err).Msgf("Error processing %s for %s", path.Base(file.Name), annotationLabel)
+				continue
+			}
+
+			for _, manifest := range manifests {
+				log.Info().Msgf("Found %s resources in %s %s: %v", annotationLabel, manifest.Kind, manifest.Name, manifest.Resources)
+				results[annotationLabel].add(template, manifest)
+			}
+		}
+	}
+
+	dependencies := make([]*helmchart.Chart, len(chrt.Dependencies()))
+	copy(dependencies, chrt.Dependencies())
+	sort.Slice(dependencies, func(i, j int) bool { return dependencies[i].Name() < dependencies[j].Name() })
+	for _, dependency := range dependencies {
+		scanLoadedChart(dependency, annotationLabels, results)
+	}
+}
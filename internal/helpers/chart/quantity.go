@@ -0,0 +1,121 @@
+package chart
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ResourceQuantity is a finops resource deployed by a manifest, with its quantity and unit, e.g. 3 of a
+// virtual machine SKU or 200 GB of a storage resource. Resources listed by name have quantity 1
+type ResourceQuantity struct {
+	Resource string
+	Quantity float64
+	Unit     string
+}
+
+// String formats the resource for logging
+func (r ResourceQuantity) String() string {
+	if r.Unit == "" {
+		return fmt.Sprintf("%s x%g", r.Resource, r.Quantity)
+	}
+	return fmt.Sprintf("%s x%g %s", r.Resource, r.Quantity, r.Unit)
+}
+
+// parseResourceEntry parses a single entry of an annotation, either a resource name or an object with
+// the resource, its quantity (1 by default) and its unit, evaluating the templates of each field. When the
+// quantity or the unit cannot be evaluated, the error is returned with the resource
+func parseResourceEntry(entry interface{}, values *ValuesFile) (ResourceQuantity, error) {
+	switch v := entry.(type) {
+	case string:
+		resource, err := evaluateField(v, values)
+		if err != nil {
+			return ResourceQuantity{}, err
+		}
+		return ResourceQuantity{Resource: resource, Quantity: 1}, nil
+	case map[string]interface{}:
+		for key := range v {
+			if key != "resource" && key != "quantity" && key != "unit" {
+				return ResourceQuantity{}, fmt.Errorf("unknown field %s, expected resource, quantity and unit", key)
+			}
+		}
+
+		resourceField, ok := v["resource"].(string)
+		if !ok || resourceField == "" {
+			return ResourceQuantity{}, fmt.Errorf("resource must be a non-empty string")
+		}
+		resource, err := evaluateField(resourceField, values)
+		if err != nil {
+			return ResourceQuantity{}, fmt.Errorf("resource: %w", err)
+		}
+
+		quantity, err := parseQuantity(v["quantity"], values)
+		if err != nil {
+			return ResourceQuantity{Resource: resource}, fmt.Errorf("quantity: %w", err)
+		}
+
+		unit := ""
+		if unitField, ok := v["unit"]; ok && unitField != nil {
+			unitString, ok := unitField.(string)
+			if !ok {
+				return ResourceQuantity{Resource: resource}, fmt.Errorf("unit must be a string")
+			}
+			if unit, err = evaluateField(unitString, values); err != nil {
+				return ResourceQuantity{Resource: resource}, fmt.Errorf("unit: %w", err)
+			}
+		}
+		return ResourceQuantity{Resource: resource, Quantity: quantity, Unit: unit}, nil
+	}
+	return ResourceQuantity{}, fmt.Errorf("entry must be a string or an object, got %T", entry)
+}
+
+// parseQuantity parses a non-negative quantity, given as a number or as a possibly templated string
+func parseQuantity(quantity interface{}, values *ValuesFile) (float64, error) {
+	switch v := quantity.(type) {
+	case nil:
+		return 1, nil
+	case float64:
+		return checkQuantity(v)
+	case int:
+		return checkQuantity(float64(v))
+	case string:
+		evaluated, err := evaluateField(v, values)
+		if err != nil {
+			return 0, err
+		}
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(evaluated), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number", evaluated)
+		}
+		return checkQuantity(parsed)
+	}
+	return 0, fmt.Errorf("must be a number or a string, got %T", quantity)
+}
+
+func checkQuantity(quantity float64) (float64, error) {
+	if quantity < 0 {
+		return 0, fmt.Errorf("cannot be negative, got %g", quantity)
+	}
+	return quantity, nil
+}
+
+// evaluateField evaluates the field if it contains a template, otherwise it returns it as-is
+func evaluateField(field string, values *ValuesFile) (string, error) {
+	if !containsTemplate(field) {
+		return field, nil
+	}
+	return evaluateTemplate(field, values)
+}
+
+// entryString formats an annotation entry for error reporting
+func entryString(entry interface{}) string {
+	if s, ok := entry.(string); ok {
+		return s
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Sprintf("%v", entry)
+	}
+	return string(data)
+}
@@ -0,0 +1,87 @@
+package chart
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+
+	helmchart "helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+)
+
+// renderLoadedChart renders the templates of a loaded chart with the helm engine, using the chart default values
+// merged with the values of the options. The result maps each template path to its rendered manifest
+func renderLoadedChart(chrt *helmchart.Chart, opts ProcessOptions) (map[string]string, error) {
+	values := opts.Values
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+
+	// Without a release, the chart is rendered as if it was installed with its own name in the default namespace
+	options := chartutil.ReleaseOptions{
+		Name:      opts.ReleaseName,
+		Namespace: opts.ReleaseNamespace,
+		IsInstall: true,
+	}
+	if options.Name == "" {
+		options.Name = chrt.Name()
+	}
+	if options.Namespace == "" {
+		options.Namespace = "default"
+	}
+
+	// The values provided by the user are not available, skip the schema validation
+	renderValues, err := chartutil.ToRenderValuesWithSchemaValidation(chrt, values, options, chartutil.DefaultCapabilities, true)
+	if err != nil {
+		return nil, fmt.Errorf("error computing render values: %w", err)
+	}
+
+	// LintMode avoids failing on 'required' values and disables lookups against the cluster
+	rendered, err := engine.Engine{LintMode: true}.Render(chrt, renderValues)
+	if err != nil {
+		return nil, fmt.Errorf("error rendering chart: %w", err)
+	}
+	return rendered, nil
+}
+
+// processRenderedChart renders a loaded chart once and collects the finops resources found in the
+// annotations of the rendered manifests, for each annotation label
+func processRenderedChart(chrt *helmchart.Chart, annotationLabels []string, opts ProcessOptions) (ProcessResults, error) {
+	rendered, err := renderLoadedChart(chrt, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	templateNames := make([]string, 0, len(rendered))
+	for name := range rendered {
+		templateNames = append(templateNames, name)
+	}
+	sort.Strings(templateNames)
+
+	results := newProcessResults(annotationLabels)
+	results.setChartVersion(chrt.Metadata.Version)
+	for _, name := range templateNames {
+		ext := filepath.Ext(name)
+		if ext != ".yaml" && ext != ".yml" {
+			continue
+		}
+
+		log.Debug().Msgf("Processing rendered %s:", name)
+		for _, annotationLabel := range annotationLabels {
+			manifests, err := ExtractManifestResources(rendered[name], annotationLabel, nil)
+			if err != nil {
+				log.Error().Err(err).Msgf("Error processing rendered %s for %s", name, annotationLabel)
+				continue
+			}
+
+			for _, manifest := range manifests {
+				log.Info().Msgf("Found %s resources in %s %s: %v", annotationLabel, manifest.Kind, manifest.Name, manifest.Resources)
+				results[annotationLabel].add(name, manifest)
+			}
+		}
+	}
+	return results, nil
+}
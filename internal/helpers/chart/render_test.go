@@ -0,0 +1,78 @@
+package chart
+
+import (
+	"testing"
+
+	helmchart "helm.sh/helm/v3/pkg/chart"
+)
+
+// renderTestChart returns an in-memory chart whose annotation is only known once the templates are rendered
+func renderTestChart(deployment string) *helmchart.Chart {
+	return &helmchart.Chart{
+		Metadata: &helmchart.Metadata{APIVersion: "v2", Name: "vm", Version: "1.2.0"},
+		Values:   map[string]interface{}{"vm": map[string]interface{}{"size": "Standard_B1s", "replicas": 1}},
+		Templates: []*helmchart.File{
+			{Name: "templates/_helpers.tpl", Data: []byte(`{{- define "vm.size" -}}{{ .Values.vm.size }}{{- end -}}`)},
+			{Name: "templates/deployment.yaml", Data: []byte(deployment)},
+		},
+	}
+}
+
+func TestProcessLoadedChartRender(t *testing.T) {
+	const label = "krateo-finops-focus-resource"
+
+	chrt := renderTestChart(`{{- range $i, $e := until (int .Values.vm.replicas) }}
+---
+apiVersion: compute.azure.com/v1
+kind: VirtualMachine
+metadata:
+  name: {{ $.Release.Name }}-{{ $i }}
+  annotations:
+    krateo-finops-focus-resource: '["{{ include "vm.size" $ }}"]'
+{{- end }}
+`)
+	opts := ProcessOptions{
+		Values:      map[string]interface{}{"vm": map[string]interface{}{"size": "Standard_D4s_v5", "replicas": 2}},
+		ReleaseName: "production",
+	}
+	results, err := ProcessLoadedChart(chrt, []string{label}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := results[label]
+
+	// The values are merged with the defaults, and the helpers and loops are evaluated by the helm engine
+	if len(result.Counts) != 1 || result.Counts["Standard_D4s_v5"] != 2 {
+		t.Fatalf("unexpected counts: %v", result.Counts)
+	}
+	provenance := result.Provenance["Standard_D4s_v5"]
+	if len(provenance) != 2 || provenance[0].Template != "vm/templates/deployment.yaml" || provenance[0].Name != "production-0" || provenance[1].Name != "production-1" {
+		t.Fatalf("unexpected provenance: %+v", provenance)
+	}
+	if result.ChartVersion != "1.2.0" {
+		t.Fatalf("unexpected chart version: %s", result.ChartVersion)
+	}
+}
+
+func TestProcessLoadedChartRenderFallback(t *testing.T) {
+	const label = "krateo-finops-focus-resource"
+
+	// The unknown function fails the rendering, the raw template is scanned instead
+	chrt := renderTestChart(`apiVersion: compute.azure.com/v1
+kind: VirtualMachine
+metadata:
+  name: {{ .Release.Name | unknownFunction }}
+  annotations:
+    krateo-finops-focus-resource: '["{{ .Values.vm.size }}"]'
+`)
+	if _, err := renderLoadedChart(chrt, ProcessOptions{}); err == nil {
+		t.Fatal("expected the rendering to fail")
+	}
+	results, err := ProcessLoadedChart(chrt, []string{label}, ProcessOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts := results[label].Counts; len(counts) != 1 || counts["Standard_B1s"] != 1 {
+		t.Fatalf("unexpected counts: %v", counts)
+	}
+}
@@ -0,0 +1,121 @@
+package chart
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	sigsyaml "sigs.k8s.io/yaml"
+
+	helmchart "helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+// EntryError reports an entry of an annotation whose template could not be evaluated. The entry is not
+// stored, instead of storing the raw template
+type EntryError struct {
+	Provenance
+	// Resource is the resource of the entry, empty if its name could not be evaluated
+	Resource string `json:"resource,omitempty"`
+	// Entry is the raw annotation entry
+	Entry string `json:"entry"`
+	// Err describes why the evaluation failed
+	Err string `json:"error"`
+}
+
+// containsTemplate reports whether the value contains a go template action
+func containsTemplate(value string) bool {
+	return strings.Contains(value, "{{") && strings.Contains(value, "}}")
+}
+
+// evaluateTemplate evaluates an annotation value with text/template and the sprig functions, against
+// stand-ins of the objects available to the chart templates: .Values, .Chart, .Release and .Capabilities
+func evaluateTemplate(text string, values *ValuesFile) (string, error) {
+	if values == nil {
+		return "", fmt.Errorf("chart values not available")
+	}
+
+	tmpl, err := template.New("annotation").Funcs(templateFuncs()).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("error parsing template: %w", err)
+	}
+
+	out := &strings.Builder{}
+	if err := tmpl.Execute(out, templateData(values)); err != nil {
+		return "", fmt.Errorf("error evaluating template: %w", err)
+	}
+
+	// Missing values are rendered as "<no value>" by text/template. They fail the entry instead of being dropped,
+	// which would store a partial resource name. Missing values handled by the template, e.g. with default, are
+	// not printed
+	if strings.Contains(out.String(), "<no value>") {
+		return "", fmt.Errorf("template refers to a missing value")
+	}
+	result := strings.TrimSpace(out.String())
+	if result == "" {
+		return "", fmt.Errorf("template evaluates to an empty value")
+	}
+	return result, nil
+}
+
+// templateData builds the top level object of the annotation templates, mirroring the one of the helm engine
+func templateData(values *ValuesFile) map[string]interface{} {
+	vals := values.Values
+	if vals == nil {
+		vals = map[string]interface{}{}
+	}
+	metadata := values.Chart
+	if metadata == nil {
+		metadata = &helmchart.Metadata{}
+	}
+
+	return map[string]interface{}{
+		"Values": vals,
+		"Chart":  metadata,
+		// The release does not exist yet, use the same options used to render the chart
+		"Release": map[string]interface{}{
+			"Name":      metadata.Name,
+			"Namespace": "default",
+			"IsUpgrade": false,
+			"IsInstall": true,
+			"Revision":  1,
+			"Service":   "Helm",
+		},
+		"Capabilities": chartutil.DefaultCapabilities,
+	}
+}
+
+// templateFuncs returns the sprig functions, without the ones reading the environment as helm does, and
+// the serialization functions added by helm
+func templateFuncs() template.FuncMap {
+	funcs := sprig.TxtFuncMap()
+	delete(funcs, "env")
+	delete(funcs, "expandenv")
+
+	funcs["toYaml"] = func(v interface{}) string {
+		data, err := sigsyaml.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSuffix(string(data), "\n")
+	}
+	funcs["toJson"] = func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+	funcs["required"] = func(message string, v interface{}) (interface{}, error) {
+		if v == nil {
+			return nil, fmt.Errorf("%s", message)
+		}
+		if s, ok := v.(string); ok && s == "" {
+			return nil, fmt.Errorf("%s", message)
+		}
+		return v, nil
+	}
+	return funcs
+}
@@ -0,0 +1,162 @@
+package chart
+
+import (
+	"testing"
+
+	helmchart "helm.sh/helm/v3/pkg/chart"
+)
+
+func TestParseAnnotationValueTemplates(t *testing.T) {
+	values := &ValuesFile{
+		Values: map[string]interface{}{
+			"sku":  "Standard_B1s",
+			"m":    map[string]interface{}{"k-with-dash": "Premium"},
+			"list": []interface{}{"Compute", "Network"},
+		},
+		Chart: &helmchart.Metadata{Name: "mychart", Version: "1.2.3"},
+	}
+
+	tests := []struct {
+		name   string
+		value  string
+		want   []string
+		errors int
+	}{
+		{
+			name:  "values path",
+			value: `["{{ .Values.sku }}", "Storage"]`,
+			want:  []string{"Standard_B1s", "Storage"},
+		},
+		{
+			name:  "default",
+			value: `["{{ .Values.missing | default \"Basic\" }}"]`,
+			want:  []string{"Basic"},
+		},
+		{
+			name:  "index",
+			value: `["{{ index .Values.m \"k-with-dash\" }}"]`,
+			want:  []string{"Premium"},
+		},
+		{
+			name:  "chart and release",
+			value: `["{{ .Release.Name }}-{{ .Chart.Version }}", "{{ upper .Values.sku }}"]`,
+			want:  []string{"mychart-1.2.3", "STANDARD_B1S"},
+		},
+		{
+			name:  "whole array",
+			value: `{{ .Values.list | toJson }}`,
+			want:  []string{"Compute", "Network"},
+		},
+		{
+			name:   "missing value",
+			value:  `["{{ .Values.missing }}", "Storage"]`,
+			want:   []string{"Storage"},
+			errors: 1,
+		},
+		{
+			name:   "partially missing value",
+			value:  `["Standard_{{ .Values.missing }}", "Storage"]`,
+			want:   []string{"Storage"},
+			errors: 1,
+		},
+		{
+			name:   "undefined function",
+			value:  `["{{ include \"helper\" . }}"]`,
+			want:   []string{},
+			errors: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resources, entryErrors, err := parseAnnotationValue(tt.value, values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entryErrors) != tt.errors {
+				t.Fatalf("expected %d entry errors, got %v", tt.errors, entryErrors)
+			}
+			if len(resources) != len(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, resources)
+			}
+			for i := range tt.want {
+				if resources[i].Resource != tt.want[i] || resources[i].Quantity != 1 {
+					t.Fatalf("expected %v, got %v", tt.want, resources)
+				}
+			}
+		})
+	}
+}
+
+func TestParseAnnotationValueQuantities(t *testing.T) {
+	values := &ValuesFile{
+		Values: map[string]interface{}{
+			"replicaCount": 3,
+			"disk":         map[string]interface{}{"size": "200"},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		value  string
+		want   []ResourceQuantity
+		errors int
+	}{
+		{
+			name:  "single object",
+			value: `{"resource": "Standard_B1s", "quantity": "{{ .Values.replicaCount }}"}`,
+			want:  []ResourceQuantity{{Resource: "Standard_B1s", Quantity: 3}},
+		},
+		{
+			name:  "list of objects and names",
+			value: `[{"resource": "Premium_LRS", "quantity": 200, "unit": "GB"}, "Standard_B1s"]`,
+			want:  []ResourceQuantity{{Resource: "Premium_LRS", Quantity: 200, Unit: "GB"}, {Resource: "Standard_B1s", Quantity: 1}},
+		},
+		{
+			name: "yaml list",
+			value: `- resource: Premium_LRS
+  quantity: "{{ .Values.disk.size }}"
+  unit: GB
+- resource: Standard_B1s
+  quantity: 2.5`,
+			want: []ResourceQuantity{{Resource: "Premium_LRS", Quantity: 200, Unit: "GB"}, {Resource: "Standard_B1s", Quantity: 2.5}},
+		},
+		{
+			name:  "unquoted template",
+			value: `[{"resource": "Standard_B1s", "quantity": {{ .Values.replicaCount }}}]`,
+			want:  []ResourceQuantity{{Resource: "Standard_B1s", Quantity: 3}},
+		},
+		{
+			name:   "invalid quantity",
+			value:  `[{"resource": "Standard_B1s", "quantity": "many"}, {"resource": "Storage", "quantity": -1}, "Compute"]`,
+			want:   []ResourceQuantity{{Resource: "Compute", Quantity: 1}},
+			errors: 2,
+		},
+		{
+			name:   "missing resource",
+			value:  `[{"quantity": 2}]`,
+			want:   []ResourceQuantity{},
+			errors: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resources, entryErrors, err := parseAnnotationValue(tt.value, values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entryErrors) != tt.errors {
+				t.Fatalf("expected %d entry errors, got %v", tt.errors, entryErrors)
+			}
+			if len(resources) != len(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, resources)
+			}
+			for i := range tt.want {
+				if resources[i] != tt.want[i] {
+					t.Fatalf("expected %v, got %v", tt.want, resources)
+				}
+			}
+		})
+	}
+}
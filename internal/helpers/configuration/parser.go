@@ -1,10 +1,12 @@
 package configuration
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	types "finops-composition-definition-parser/apis"
 
@@ -19,11 +21,44 @@ type Configuration struct {
 	DebugLevel      zerolog.Level       `json:"debugLevel" yaml:"debugLevel"`
 	WebserviceUrl   string              `json:"webserviceUrl" yaml:"webserviceUrl"`
 	DatabaseConfig  types.NamespaceName `json:"databaseConfigName" yaml:"databaseConfigName"`
-}
-
-func (c *Configuration) Default() {
-	c.WebServicePort = 8085
-	c.DebugLevel = zerolog.DebugLevel
+	WatchMode       bool                `json:"watchMode" yaml:"watchMode"`
+	ResyncInterval  time.Duration       `json:"resyncInterval" yaml:"resyncInterval"`
+	QueueWorkers    int                 `json:"queueWorkers" yaml:"queueWorkers"`
+	QueueMaxRetries int                 `json:"queueMaxRetries" yaml:"queueMaxRetries"`
+	WorkingDir      string              `json:"workingDir" yaml:"workingDir"`
+	ChartInMemory   bool                `json:"chartInMemory" yaml:"chartInMemory"`
+	// Sink storing the annotations, the notebook by default
+	SinkType        string `json:"sinkType" yaml:"sinkType"`
+	SinkDatabaseUrl string `json:"sinkDatabaseUrl" yaml:"sinkDatabaseUrl"`
+	SinkDirectory   string `json:"sinkDirectory" yaml:"sinkDirectory"`
+	SinkFileFormat  string `json:"sinkFileFormat" yaml:"sinkFileFormat"`
+	// Client of the notebook, zero durations and thresholds use the defaults of the client
+	NotebookTimeout          time.Duration `json:"notebookTimeout" yaml:"notebookTimeout"`
+	NotebookMaxRetries       int           `json:"notebookMaxRetries" yaml:"notebookMaxRetries"`
+	NotebookBreakerThreshold int           `json:"notebookBreakerThreshold" yaml:"notebookBreakerThreshold"`
+	NotebookBreakerCooldown  time.Duration `json:"notebookBreakerCooldown" yaml:"notebookBreakerCooldown"`
+	NotebookCAFile           string        `json:"notebookCAFile" yaml:"notebookCAFile"`
+	NotebookCertFile         string        `json:"notebookCertFile" yaml:"notebookCertFile"`
+	NotebookKeyFile          string        `json:"notebookKeyFile" yaml:"notebookKeyFile"`
+	NotebookVerifyWrites     bool          `json:"notebookVerifyWrites" yaml:"notebookVerifyWrites"`
+	// Directory of the outbox persisting the operations until the sink acknowledges them, disabled if empty
+	OutboxDirectory string `json:"outboxDirectory" yaml:"outboxDirectory"`
+	// Secrets of the chart and database credentials, read from a single namespace if set and from an informer cache if enabled
+	SecretsNamespace string `json:"secretsNamespace" yaml:"secretsNamespace"`
+	SecretsInformer  bool   `json:"secretsInformer" yaml:"secretsInformer"`
+	// Download the chart dependencies that are not vendored in the chart archive
+	FetchDependencies bool `json:"fetchDependencies" yaml:"fetchDependencies"`
+	// Namespaces, besides the one of each composition definition, from which the values profiles ConfigMaps can be read
+	ProfilesNamespaces []string `json:"profilesNamespaces" yaml:"profilesNamespaces"`
+	// Process the events on composition instances and store their annotations in the composition table
+	ProcessCompositions bool   `json:"processCompositions" yaml:"processCompositions"`
+	CompositionTable    string `json:"compositionTable" yaml:"compositionTable"`
+	// Labels to extract with their tables, by default only AnnotationLabel, stored in AnnotationTable and CompositionTable
+	AnnotationMappings []types.AnnotationMapping `json:"annotationMappings" yaml:"annotationMappings"`
+	// Limits of the chart archive extraction, zero values use the defaults
+	ExtractMaxFileSize  int64 `json:"extractMaxFileSize" yaml:"extractMaxFileSize"`
+	ExtractMaxTotalSize int64 `json:"extractMaxTotalSize" yaml:"extractMaxTotalSize"`
+	ExtractMaxFiles     int64 `json:"extractMaxFiles" yaml:"extractMaxFiles"`
 }
 
 func ParseConfig() (Configuration, error) {
@@ -32,18 +67,87 @@ func ParseConfig() (Configuration, error) {
 		return Configuration{}, err
 	}
 
+	// The notebook of the finops-database-handler is the default sink, the only one needing its URL
+	sinkType := strings.ToLower(os.Getenv("SINK_TYPE"))
+	switch sinkType {
+	case "":
+		sinkType = "notebook"
+	case "notebook", "cratedb", "postgres", "file", "stdout":
+	default:
+		return Configuration{}, fmt.Errorf("SINK_TYPE must be one of 'notebook', 'cratedb', 'postgres', 'file' or 'stdout'")
+	}
+
 	webserviceUrl := os.Getenv("URL_DATABASE_HANDLER_PRICING_NOTEBOOK")
-	if webserviceUrl == "" {
+	if webserviceUrl == "" && sinkType == "notebook" {
 		return Configuration{}, fmt.Errorf("database handler URL cannot be empty")
 	}
 
+	// The database sinks connect directly to the database over the PostgreSQL wire protocol
+	sinkDatabaseUrl := os.Getenv("SINK_DATABASE_URL")
+	if sinkDatabaseUrl == "" && (sinkType == "cratedb" || sinkType == "postgres") {
+		return Configuration{}, fmt.Errorf("SINK_DATABASE_URL cannot be empty for the %s sink", sinkType)
+	}
+
+	// The file sink writes a JSON file for each record, or NDJSON operations, in a local directory
+	sinkDirectory := os.Getenv("SINK_DIRECTORY")
+	if sinkDirectory == "" && sinkType == "file" {
+		return Configuration{}, fmt.Errorf("SINK_DIRECTORY cannot be empty for the file sink")
+	}
+	sinkFileFormat := strings.ToLower(os.Getenv("SINK_FILE_FORMAT"))
+	if sinkFileFormat != "" && sinkFileFormat != "json" && sinkFileFormat != "ndjson" {
+		return Configuration{}, fmt.Errorf("SINK_FILE_FORMAT must be either 'json' or 'ndjson'")
+	}
+
+	// Timeout of each notebook call, retries of the transient failures and circuit breaker
+	notebookTimeout, err := durationFromEnv("NOTEBOOK_TIMEOUT")
+	if err != nil {
+		return Configuration{}, err
+	}
+	notebookMaxRetries := 3
+	if notebookMaxRetriesEnv := os.Getenv("NOTEBOOK_MAX_RETRIES"); notebookMaxRetriesEnv != "" {
+		notebookMaxRetries, err = strconv.Atoi(notebookMaxRetriesEnv)
+		if err != nil || notebookMaxRetries < 0 {
+			return Configuration{}, fmt.Errorf("could not parse NOTEBOOK_MAX_RETRIES: must be a non-negative integer")
+		}
+	}
+	notebookBreakerThreshold, err := int64FromEnv("NOTEBOOK_BREAKER_THRESHOLD")
+	if err != nil {
+		return Configuration{}, err
+	}
+	notebookBreakerCooldown, err := durationFromEnv("NOTEBOOK_BREAKER_COOLDOWN")
+	if err != nil {
+		return Configuration{}, err
+	}
+	// The writes reported as successful by the notebook are read back only if enabled
+	notebookVerifyWrites := false
+	if notebookVerifyWritesEnv := os.Getenv("NOTEBOOK_VERIFY_WRITES"); notebookVerifyWritesEnv != "" {
+		notebookVerifyWrites, err = strconv.ParseBool(notebookVerifyWritesEnv)
+		if err != nil {
+			return Configuration{}, fmt.Errorf("could not parse NOTEBOOK_VERIFY_WRITES: %w", err)
+		}
+	}
+
+	// The outbox should be on a persistent volume, so that the pending operations survive restarts
+	outboxDirectory := os.Getenv("OUTBOX_DIRECTORY")
+
+	// The informer lists and watches the Secrets, SECRETS_NAMESPACE limits it to a single namespace
+	secretsInformer := false
+	if secretsInformerEnv := os.Getenv("SECRETS_INFORMER"); secretsInformerEnv != "" {
+		secretsInformer, err = strconv.ParseBool(secretsInformerEnv)
+		if err != nil {
+			return Configuration{}, fmt.Errorf("could not parse SECRETS_INFORMER: %w", err)
+		}
+	}
+
+	// The notebook needs the credentials of the DatabaseConfig, the database sinks use them instead of the
+	// ones of SINK_DATABASE_URL if set, and the file and stdout sinks do not need any
 	databaseConfigName := os.Getenv("DATABASE_CONFIG_NAME")
-	if webserviceUrl == "" {
+	if databaseConfigName == "" && sinkType == "notebook" {
 		return Configuration{}, fmt.Errorf("database config name cannot be empty")
 	}
 
 	databaseConfigNamespace := os.Getenv("DATABASE_CONFIG_NAMESPACE")
-	if webserviceUrl == "" {
+	if databaseConfigNamespace == "" && (sinkType == "notebook" || databaseConfigName != "") {
 		return Configuration{}, fmt.Errorf("database config namespace cannot be empty")
 	}
 
@@ -59,6 +163,115 @@ func ParseConfig() (Configuration, error) {
 		log.Warn().Msgf("annotation label is empty, using default value '%s'", annotationLabel)
 	}
 
+	compositionTable := os.Getenv("COMPOSITION_ANNOTATION_TABLE")
+	if compositionTable == "" {
+		compositionTable = "composition_annotations"
+	}
+
+	// Several labels can be extracted in the same chart processing, each one stored in its own tables
+	annotationMappings := []types.AnnotationMapping{{
+		Label:            annotationLabel,
+		Table:            annotationTable,
+		CompositionTable: compositionTable,
+	}}
+	if annotationMappingsEnv := os.Getenv("ANNOTATION_MAPPINGS"); annotationMappingsEnv != "" {
+		annotationMappings, err = parseAnnotationMappings(annotationMappingsEnv, compositionTable)
+		if err != nil {
+			return Configuration{}, err
+		}
+	}
+
+	// Values profiles ConfigMaps are read from the namespace of the composition definition, or from the ones listed
+	var profilesNamespaces []string
+	for _, namespace := range strings.Split(os.Getenv("PROFILES_NAMESPACES"), ",") {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			profilesNamespaces = append(profilesNamespaces, namespace)
+		}
+	}
+
+	// Composition instances are processed only if enabled, their definitions are always processed
+	processCompositions := false
+	if processCompositionsEnv := os.Getenv("PROCESS_COMPOSITIONS"); processCompositionsEnv != "" {
+		processCompositions, err = strconv.ParseBool(processCompositionsEnv)
+		if err != nil {
+			return Configuration{}, fmt.Errorf("could not parse PROCESS_COMPOSITIONS: %w", err)
+		}
+	}
+
+	// Watch CompositionDefinitions with an informer, in addition to the events from the eventrouter
+	watchMode := false
+	if watchModeEnv := os.Getenv("WATCH_COMPOSITION_DEFINITIONS"); watchModeEnv != "" {
+		watchMode, err = strconv.ParseBool(watchModeEnv)
+		if err != nil {
+			return Configuration{}, fmt.Errorf("could not parse WATCH_COMPOSITION_DEFINITIONS: %w", err)
+		}
+	}
+
+	// Interval of the full resync of the CompositionDefinitions, zero only resyncs at startup
+	resyncInterval := time.Hour
+	if resyncIntervalEnv := os.Getenv("RESYNC_INTERVAL"); resyncIntervalEnv != "" {
+		resyncInterval, err = time.ParseDuration(resyncIntervalEnv)
+		if err != nil {
+			return Configuration{}, fmt.Errorf("could not parse RESYNC_INTERVAL: %w", err)
+		}
+	}
+
+	// Workers processing the events and number of retries with exponential backoff for each event
+	queueWorkers := 2
+	if queueWorkersEnv := os.Getenv("QUEUE_WORKERS"); queueWorkersEnv != "" {
+		queueWorkers, err = strconv.Atoi(queueWorkersEnv)
+		if err != nil {
+			return Configuration{}, fmt.Errorf("could not parse QUEUE_WORKERS: %w", err)
+		}
+	}
+
+	queueMaxRetries := 10
+	if queueMaxRetriesEnv := os.Getenv("QUEUE_MAX_RETRIES"); queueMaxRetriesEnv != "" {
+		queueMaxRetries, err = strconv.Atoi(queueMaxRetriesEnv)
+		if err != nil {
+			return Configuration{}, fmt.Errorf("could not parse QUEUE_MAX_RETRIES: %w", err)
+		}
+	}
+
+	// Base path of the temporary directories where charts are extracted
+	workingDir := os.Getenv("WORKING_DIRECTORY")
+	if workingDir == "" {
+		workingDir = os.TempDir()
+	}
+
+	// Charts are extracted to the working directory ("disk") or loaded in memory ("memory")
+	chartInMemory := false
+	switch strings.ToLower(os.Getenv("CHART_LOADING")) {
+	case "", "disk":
+		chartInMemory = false
+	case "memory":
+		chartInMemory = true
+	default:
+		return Configuration{}, fmt.Errorf("CHART_LOADING must be either 'disk' or 'memory'")
+	}
+
+	// Dependencies declared in Chart.yaml but missing from the charts directory are downloaded only if enabled
+	fetchDependencies := false
+	if fetchDependenciesEnv := os.Getenv("FETCH_DEPENDENCIES"); fetchDependenciesEnv != "" {
+		fetchDependencies, err = strconv.ParseBool(fetchDependenciesEnv)
+		if err != nil {
+			return Configuration{}, fmt.Errorf("could not parse FETCH_DEPENDENCIES: %w", err)
+		}
+	}
+
+	extractMaxFileSize, err := int64FromEnv("EXTRACT_MAX_FILE_SIZE")
+	if err != nil {
+		return Configuration{}, err
+	}
+	extractMaxTotalSize, err := int64FromEnv("EXTRACT_MAX_TOTAL_SIZE")
+	if err != nil {
+		return Configuration{}, err
+	}
+	extractMaxFiles, err := int64FromEnv("EXTRACT_MAX_FILES")
+	if err != nil {
+		return Configuration{}, err
+	}
+
 	debugLevel := zerolog.InfoLevel
 	switch strings.ToLower(os.Getenv("DEBUG_LEVEL")) {
 	case "debug":
@@ -75,5 +288,110 @@ func ParseConfig() (Configuration, error) {
 		AnnotationTable: annotationTable,
 		WebserviceUrl:   webserviceUrl,
 		DatabaseConfig:  types.NamespaceName{Name: databaseConfigName, Namespace: databaseConfigNamespace},
+		WatchMode:       watchMode,
+		ResyncInterval:  resyncInterval,
+		QueueWorkers:    queueWorkers,
+		QueueMaxRetries: queueMaxRetries,
+		WorkingDir:      workingDir,
+		ChartInMemory:   chartInMemory,
+
+		FetchDependencies:  fetchDependencies,
+		ProfilesNamespaces: profilesNamespaces,
+
+		ProcessCompositions: processCompositions,
+		CompositionTable:    compositionTable,
+		AnnotationMappings:  annotationMappings,
+
+		ExtractMaxFileSize:  extractMaxFileSize,
+		ExtractMaxTotalSize: extractMaxTotalSize,
+		ExtractMaxFiles:     extractMaxFiles,
+
+		SinkType:        sinkType,
+		SinkDatabaseUrl: sinkDatabaseUrl,
+		SinkDirectory:   sinkDirectory,
+		SinkFileFormat:  sinkFileFormat,
+		OutboxDirectory: outboxDirectory,
+
+		SecretsNamespace: os.Getenv("SECRETS_NAMESPACE"),
+		SecretsInformer:  secretsInformer,
+
+		NotebookTimeout:          notebookTimeout,
+		NotebookMaxRetries:       notebookMaxRetries,
+		NotebookBreakerThreshold: int(notebookBreakerThreshold),
+		NotebookBreakerCooldown:  notebookBreakerCooldown,
+		NotebookCAFile:           os.Getenv("NOTEBOOK_CA_FILE"),
+		NotebookCertFile:         os.Getenv("NOTEBOOK_CERT_FILE"),
+		NotebookKeyFile:          os.Getenv("NOTEBOOK_KEY_FILE"),
+		NotebookVerifyWrites:     notebookVerifyWrites,
 	}, nil
 }
+
+// parseAnnotationMappings parses the JSON list of label to tables mappings, e.g.
+// [{"label": "krateo-finops-focus-resource", "table": "pricing_annotations", "compositionTable": "pricing_composition_annotations"}]
+func parseAnnotationMappings(value string, compositionTable string) ([]types.AnnotationMapping, error) {
+	annotationMappings := []types.AnnotationMapping{}
+	if err := json.Unmarshal([]byte(value), &annotationMappings); err != nil {
+		return nil, fmt.Errorf("could not parse ANNOTATION_MAPPINGS: %w", err)
+	}
+	if len(annotationMappings) == 0 {
+		return nil, fmt.Errorf("ANNOTATION_MAPPINGS cannot be empty")
+	}
+
+	// Rows of different labels stored in the same table would overwrite each other, since they share the ids
+	labels := map[string]bool{}
+	tables := map[string]bool{}
+	for _, mapping := range annotationMappings {
+		if mapping.Label == "" || mapping.Table == "" {
+			return nil, fmt.Errorf("each of the ANNOTATION_MAPPINGS needs a label and a table")
+		}
+		if labels[mapping.Label] {
+			return nil, fmt.Errorf("label %s is mapped more than once in ANNOTATION_MAPPINGS", mapping.Label)
+		}
+		labels[mapping.Label] = true
+		if mapping.Table == compositionTable {
+			return nil, fmt.Errorf("table %s of label %s in ANNOTATION_MAPPINGS is the COMPOSITION_ANNOTATION_TABLE", mapping.Table, mapping.Label)
+		}
+		for _, table := range []string{mapping.Table, mapping.CompositionTable} {
+			if table == "" {
+				continue
+			}
+			if tables[table] {
+				return nil, fmt.Errorf("table %s is used more than once in ANNOTATION_MAPPINGS", table)
+			}
+			tables[table] = true
+		}
+	}
+	return annotationMappings, nil
+}
+
+// int64FromEnv parses the environment variable as a non-negative integer, returning zero if it is not set
+func int64FromEnv(name string) (int64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse %s: %w", name, err)
+	}
+	if parsed < 0 {
+		return 0, fmt.Errorf("%s cannot be negative", name)
+	}
+	return parsed, nil
+}
+
+// durationFromEnv parses the environment variable as a non-negative duration, returning zero if it is not set
+func durationFromEnv(name string) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse %s: %w", name, err)
+	}
+	if parsed < 0 {
+		return 0, fmt.Errorf("%s cannot be negative", name)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,104 @@
+package configuration
+
+import (
+	"testing"
+)
+
+// setEnv sets the environment variables for the duration of the test, unsetting the sink ones not given
+func setEnv(t *testing.T, env map[string]string) {
+	for _, key := range []string{"SINK_TYPE", "URL_DATABASE_HANDLER_PRICING_NOTEBOOK", "SINK_DATABASE_URL", "SINK_DIRECTORY",
+		"SINK_FILE_FORMAT", "DATABASE_CONFIG_NAME", "DATABASE_CONFIG_NAMESPACE"} {
+		t.Setenv(key, "")
+	}
+	t.Setenv("PORT_FINOPS_COMPOSITION_DEFINITION_PARSER", "8080")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+}
+
+func TestParseConfigSinks(t *testing.T) {
+	databaseConfig := map[string]string{"DATABASE_CONFIG_NAME": "finops-database-handler", "DATABASE_CONFIG_NAMESPACE": "krateo-system"}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"notebook", map[string]string{"URL_DATABASE_HANDLER_PRICING_NOTEBOOK": "http://notebook"}, true},
+		{"notebook", map[string]string{"URL_DATABASE_HANDLER_PRICING_NOTEBOOK": "http://notebook", "DATABASE_CONFIG_NAME": "finops-database-handler", "DATABASE_CONFIG_NAMESPACE": "krateo-system"}, false},
+		{"notebook", databaseConfig, true},
+		{"cratedb", map[string]string{"SINK_DATABASE_URL": "postgres://crate:5432/doc"}, false},
+		{"cratedb", map[string]string{}, true},
+		{"postgres", map[string]string{"SINK_DATABASE_URL": "postgres://postgres:5432/finops", "DATABASE_CONFIG_NAME": "finops-database-handler", "DATABASE_CONFIG_NAMESPACE": "krateo-system"}, false},
+		{"postgres", map[string]string{"SINK_DATABASE_URL": "postgres://postgres:5432/finops", "DATABASE_CONFIG_NAME": "finops-database-handler"}, true},
+		{"file", map[string]string{"SINK_DIRECTORY": "/tmp/annotations", "SINK_FILE_FORMAT": "ndjson"}, false},
+		{"file", map[string]string{"SINK_DIRECTORY": "/tmp/annotations", "SINK_FILE_FORMAT": "csv"}, true},
+		{"file", map[string]string{}, true},
+		{"stdout", map[string]string{}, false},
+		{"unknown", map[string]string{}, true},
+	}
+	for _, test := range tests {
+		env := map[string]string{"SINK_TYPE": test.name}
+		for key, value := range test.env {
+			env[key] = value
+		}
+		setEnv(t, env)
+
+		configuration, err := ParseConfig()
+		if test.wantErr {
+			if err == nil {
+				t.Fatalf("expected an error for the %s sink with %v", test.name, test.env)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for the %s sink with %v: %v", test.name, test.env, err)
+		}
+		if configuration.SinkType != test.name {
+			t.Fatalf("expected the %s sink, got %s", test.name, configuration.SinkType)
+		}
+	}
+}
+
+func TestParseAnnotationMappings(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"valid", `[{"label": "a", "table": "a_annotations", "compositionTable": "a_composition_annotations"}, {"label": "b", "table": "b_annotations"}]`, false},
+		{"duplicate label", `[{"label": "a", "table": "a_annotations"}, {"label": "a", "table": "b_annotations"}]`, true},
+		{"duplicate table", `[{"label": "a", "table": "annotations"}, {"label": "b", "table": "annotations"}]`, true},
+		{"table used as composition table", `[{"label": "a", "table": "a_annotations", "compositionTable": "b_annotations"}, {"label": "b", "table": "b_annotations"}]`, true},
+		{"composition annotation table", `[{"label": "a", "table": "composition_annotations"}]`, true},
+		{"missing table", `[{"label": "a"}]`, true},
+		{"empty", `[]`, true},
+	}
+	for _, test := range tests {
+		_, err := parseAnnotationMappings(test.value, "composition_annotations")
+		if test.wantErr && err == nil {
+			t.Fatalf("%s: expected an error for %s", test.name, test.value)
+		}
+		if !test.wantErr && err != nil {
+			t.Fatalf("%s: unexpected error for %s: %v", test.name, test.value, err)
+		}
+	}
+}
+
+func TestParseConfigRequired(t *testing.T) {
+	env := map[string]string{"SINK_TYPE": "notebook", "URL_DATABASE_HANDLER_PRICING_NOTEBOOK": "http://notebook",
+		"DATABASE_CONFIG_NAME": "finops-database-handler", "DATABASE_CONFIG_NAMESPACE": "krateo-system"}
+	setEnv(t, env)
+	if _, err := ParseConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, key := range []string{"PORT_FINOPS_COMPOSITION_DEFINITION_PARSER", "URL_DATABASE_HANDLER_PRICING_NOTEBOOK",
+		"DATABASE_CONFIG_NAME", "DATABASE_CONFIG_NAMESPACE"} {
+		setEnv(t, env)
+		t.Setenv(key, "")
+		if _, err := ParseConfig(); err == nil {
+			t.Fatalf("expected an error when %s is not set", key)
+		}
+	}
+}
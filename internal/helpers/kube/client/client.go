@@ -20,6 +20,19 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// CompositionDefinitionResource is the resource of the Krateo CompositionDefinitions
+var CompositionDefinitionResource = schema.GroupVersionResource{
+	Group:    "core.krateo.io",
+	Version:  "v1alpha1",
+	Resource: "compositiondefinitions",
+}
+
+// ConfigMapResource is the resource of the core ConfigMaps
+var ConfigMapResource = schema.GroupVersionResource{
+	Version:  "v1",
+	Resource: "configmaps",
+}
+
 func NewDynamicClient(rc *rest.Config) (*dynamic.DynamicClient, error) {
 	config := *rc
 	config.APIPath = "/api"
@@ -31,7 +44,7 @@ func NewDynamicClient(rc *rest.Config) (*dynamic.DynamicClient, error) {
 	return dynamic.NewForConfig(&config)
 }
 
-func GetObj(ctx context.Context, cr *types.Reference, dynClient *dynamic.DynamicClient) (*unstructured.Unstructured, error) {
+func GetObj(ctx context.Context, cr *types.Reference, dynClient dynamic.Interface) (*unstructured.Unstructured, error) {
 	gv, err := schema.ParseGroupVersion(cr.ApiVersion)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse GroupVersion from composition reference ApiVersion: %w", err)
@@ -49,6 +62,20 @@ func GetObj(ctx context.Context, cr *types.Reference, dynClient *dynamic.Dynamic
 	return res, nil
 }
 
+// GetConfigMapData returns the data of the ConfigMap and its resource version
+func GetConfigMapData(ctx context.Context, name, namespace string, dynClient dynamic.Interface) (map[string]string, string, error) {
+	res, err := dynClient.Resource(ConfigMapResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to retrieve configmap %s in namespace %s: %w", name, namespace, err)
+	}
+
+	data, _, err := unstructured.NestedStringMap(res.Object, "data")
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to read data of configmap %s in namespace %s: %w", name, namespace, err)
+	}
+	return data, res.GetResourceVersion(), nil
+}
+
 func InferGroupResource(a, k string) schema.GroupResource {
 	gv, err := schema.ParseGroupVersion(a)
 	if err != nil {
@@ -76,7 +103,7 @@ func InferGroupResource(a, k string) schema.GroupResource {
 	}
 }
 
-func GetDatabaseUsernamePassword(ctx context.Context, databaseConfigName, databaseConfigNamespace string, dynClient *dynamic.DynamicClient, rc *rest.Config) (string, string, error) {
+func GetDatabaseUsernamePassword(ctx context.Context, databaseConfigName, databaseConfigNamespace string, dynClient dynamic.Interface, secrets *secretsHelper.Accessor) (string, string, error) {
 	// DatabaseConfig to access the database
 	databaseConfigReference := &types.Reference{
 		ApiVersion: "finops.krateo.io/v1",
@@ -100,13 +127,13 @@ func GetDatabaseUsernamePassword(ctx context.Context, databaseConfigName, databa
 	databaseConfigSpec := databaseConfig.Spec
 
 	// The password field is a reference to a secret, get the secret
-	dbPasswordSecret, err := secretsHelper.Get(ctx, rc, &databaseConfigSpec.PasswordSecretRef)
+	// The Secret is read from the API server, the credentials are read again right after it changed
+	dbPassword, err := secrets.FetchValue(ctx, &databaseConfigSpec.PasswordSecretRef)
 	if err != nil {
 		return "", "", fmt.Errorf("error while retrieving database password secret: %v", err)
 	}
 
 	// Use the username and password to call the notebook
-	dbPassword := string(dbPasswordSecret.Data[databaseConfigSpec.PasswordSecretRef.Key])
 	dbUsername := databaseConfigSpec.Username
 
 	return dbUsername, dbPassword, nil
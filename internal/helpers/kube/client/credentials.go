@@ -0,0 +1,192 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	types "finops-composition-definition-parser/apis"
+	secretsHelper "finops-composition-definition-parser/internal/helpers/kube/secrets"
+)
+
+// DatabaseConfigResource is the resource of the finops DatabaseConfigs
+var DatabaseConfigResource = schema.GroupVersionResource{
+	Group:    "finops.krateo.io",
+	Version:  "v1",
+	Resource: "databaseconfigs",
+}
+
+// SecretResource is the resource of the core Secrets
+var SecretResource = schema.GroupVersionResource{
+	Version:  "v1",
+	Resource: "secrets",
+}
+
+// DatabaseCredentials caches the username and password of a DatabaseConfig. Run watches the DatabaseConfig
+// and its password Secret, so that the credentials are resolved again after they change
+type DatabaseCredentials struct {
+	Name      string
+	Namespace string
+	DynClient dynamic.Interface
+	Secrets   *secretsHelper.Accessor
+
+	mutex      sync.Mutex
+	cached     bool
+	generation int
+	username   string
+	password   string
+	// secretRef is the password Secret being watched, secretCancel stops its informer
+	secretRef    string
+	secretCancel context.CancelFunc
+}
+
+// Get returns the cached credentials, resolving them if they were never read or have changed since
+func (d *DatabaseCredentials) Get(ctx context.Context) (string, string, error) {
+	d.mutex.Lock()
+	if d.cached {
+		defer d.mutex.Unlock()
+		return d.username, d.password, nil
+	}
+	generation := d.generation
+	d.mutex.Unlock()
+
+	username, password, err := GetDatabaseUsernamePassword(ctx, d.Name, d.Namespace, d.DynClient, d.Secrets)
+	if err != nil {
+		return "", "", err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	// The credentials changed while they were being resolved, they are resolved again on the next call
+	if generation == d.generation {
+		d.username, d.password, d.cached = username, password, true
+	}
+	return username, password, nil
+}
+
+// Invalidate drops the cached credentials
+func (d *DatabaseCredentials) Invalidate() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.cached = false
+	d.generation++
+}
+
+// Run watches the DatabaseConfig and its password Secret and blocks until the context is cancelled
+func (d *DatabaseCredentials) Run(ctx context.Context) error {
+	factory := namedInformerFactory(d.DynClient, d.Name, d.Namespace)
+	informer := factory.ForResource(DatabaseConfigResource).Informer()
+
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			d.databaseConfigChanged(ctx, obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			d.databaseConfigChanged(ctx, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			log.Warn().Msgf("database config %s %s deleted", d.Name, d.Namespace)
+			d.Invalidate()
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error adding event handler to database config informer: %w", err)
+	}
+
+	log.Info().Msgf("watching database config %s %s", d.Name, d.Namespace)
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("timed out waiting for the database config informer cache to sync")
+	}
+
+	<-ctx.Done()
+	factory.Shutdown()
+	return nil
+}
+
+// databaseConfigChanged invalidates the credentials and moves the watch to the password Secret now referenced
+func (d *DatabaseCredentials) databaseConfigChanged(ctx context.Context, obj interface{}) {
+	databaseConfigUnstructured, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		log.Error().Msgf("unexpected object of type %T from informer", obj)
+		return
+	}
+	databaseConfig := &types.DatabaseConfig{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(databaseConfigUnstructured.Object, databaseConfig); err != nil {
+		log.Error().Err(err).Msg("unable to convert from unstructured to database config")
+		return
+	}
+	d.Invalidate()
+
+	secretRef := databaseConfig.Spec.PasswordSecretRef
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.secretRef == secretRef.Namespace+"/"+secretRef.Name {
+		return
+	}
+	if d.secretCancel != nil {
+		d.secretCancel()
+	}
+	d.secretRef = secretRef.Namespace + "/" + secretRef.Name
+
+	secretCtx, cancel := context.WithCancel(ctx)
+	d.secretCancel = cancel
+	go func() {
+		if err := d.watchSecret(secretCtx, secretRef.Name, secretRef.Namespace); err != nil {
+			log.Error().Err(err).Msgf("database password secret %s %s watcher stopped", secretRef.Name, secretRef.Namespace)
+		}
+	}()
+}
+
+// watchSecret invalidates the credentials on each change of the password Secret, until the context is cancelled
+func (d *DatabaseCredentials) watchSecret(ctx context.Context, name, namespace string) error {
+	factory := namedInformerFactory(d.DynClient, name, namespace)
+	informer := factory.ForResource(SecretResource).Informer()
+
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			// The Secret may have been created after the credentials were resolved
+			d.Invalidate()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldUnstructured, okOld := oldObj.(*unstructured.Unstructured)
+			newUnstructured, okNew := newObj.(*unstructured.Unstructured)
+			if okOld && okNew && oldUnstructured.GetResourceVersion() == newUnstructured.GetResourceVersion() {
+				return
+			}
+			log.Info().Msgf("database password secret %s %s changed", name, namespace)
+			d.Invalidate()
+		},
+		DeleteFunc: func(obj interface{}) {
+			log.Warn().Msgf("database password secret %s %s deleted", name, namespace)
+			d.Invalidate()
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error adding event handler to secret informer: %w", err)
+	}
+
+	log.Debug().Msgf("watching database password secret %s %s", name, namespace)
+	factory.Start(ctx.Done())
+	<-ctx.Done()
+	factory.Shutdown()
+	return nil
+}
+
+// namedInformerFactory returns an informer factory restricted to the object with the given name and namespace
+func namedInformerFactory(dynClient dynamic.Interface, name, namespace string) dynamicinformer.DynamicSharedInformerFactory {
+	return dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynClient, 0, namespace, func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+	})
+}
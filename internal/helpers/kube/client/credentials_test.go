@@ -0,0 +1,172 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	secretsHelper "finops-composition-definition-parser/internal/helpers/kube/secrets"
+)
+
+func testDatabaseConfig(username string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "finops.krateo.io/v1",
+		"kind":       "DatabaseConfig",
+		"metadata":   map[string]interface{}{"name": "database", "namespace": "finops"},
+		"spec": map[string]interface{}{
+			"username":          username,
+			"passwordSecretRef": map[string]interface{}{"name": "credentials", "namespace": "finops", "key": "password"},
+		},
+	}}
+}
+
+func testSecret(password string) *corev1.Secret {
+	return &corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: "finops"},
+		Data:       map[string][]byte{"password": []byte(password)},
+	}
+}
+
+// testCredentials returns the credentials of a DatabaseConfig served by fake clients, with the password Secret
+// read from the clientset and watched through the dynamic client
+func testCredentials(t *testing.T) (*DatabaseCredentials, *dynamicfake.FakeDynamicClient, *fake.Clientset) {
+	t.Helper()
+	secretObject, err := runtime.DefaultUnstructuredConverter.ToUnstructured(testSecret("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dynClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		DatabaseConfigResource: "DatabaseConfigList",
+		SecretResource:         "SecretList",
+	}, testDatabaseConfig("user"), &unstructured.Unstructured{Object: secretObject})
+	client := fake.NewSimpleClientset(testSecret("secret"))
+
+	credentials := &DatabaseCredentials{
+		Name:      "database",
+		Namespace: "finops",
+		DynClient: dynClient,
+		Secrets:   secretsHelper.NewAccessorForClient(client, secretsHelper.Options{}),
+	}
+	return credentials, dynClient, client
+}
+
+// waitCredentials waits until the credentials are the expected ones
+func waitCredentials(t *testing.T, credentials *DatabaseCredentials, username, password string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		gotUsername, gotPassword, err := credentials.Get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotUsername == username && gotPassword == password {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the credentials %s %s, got %s %s", username, password, gotUsername, gotPassword)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func countGets(dynClient *dynamicfake.FakeDynamicClient) int {
+	gets := 0
+	for _, action := range dynClient.Actions() {
+		if action.GetVerb() == "get" && action.GetResource() == DatabaseConfigResource {
+			gets++
+		}
+	}
+	return gets
+}
+
+func TestDatabaseCredentialsCache(t *testing.T) {
+	credentials, dynClient, client := testCredentials(t)
+	ctx := context.Background()
+
+	waitCredentials(t, credentials, "user", "secret")
+	waitCredentials(t, credentials, "user", "secret")
+	if gets := countGets(dynClient); gets != 1 {
+		t.Fatalf("expected the credentials to be read once, got %d reads", gets)
+	}
+
+	// Without an invalidation, the change is not seen
+	if _, err := client.CoreV1().Secrets("finops").Update(ctx, testSecret("rotated"), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitCredentials(t, credentials, "user", "secret")
+
+	credentials.Invalidate()
+	waitCredentials(t, credentials, "user", "rotated")
+}
+
+func TestDatabaseCredentialsWatch(t *testing.T) {
+	credentials, dynClient, client := testCredentials(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	go func() {
+		defer close(done)
+		// The informers may not be synced yet when the test ends
+		if err := credentials.Run(ctx); err != nil && ctx.Err() == nil {
+			t.Error(err)
+		}
+	}()
+	waitCredentials(t, credentials, "user", "secret")
+
+	// A change of the DatabaseConfig invalidates the credentials
+	if _, err := dynClient.Resource(DatabaseConfigResource).Namespace("finops").Update(ctx, testDatabaseConfig("admin"), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitCredentials(t, credentials, "admin", "secret")
+
+	// A change of the password Secret invalidates the credentials, the Secret is then read from the API server
+	if _, err := client.CoreV1().Secrets("finops").Update(ctx, testSecret("rotated"), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	secretObject, err := runtime.DefaultUnstructuredConverter.ToUnstructured(testSecret("rotated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := &unstructured.Unstructured{Object: secretObject}
+	secret.SetResourceVersion("2")
+	if _, err := dynClient.Resource(SecretResource).Namespace("finops").Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitCredentials(t, credentials, "admin", "rotated")
+}
+
+func TestDatabaseCredentialsInvalidatedWhileReading(t *testing.T) {
+	credentials, dynClient, _ := testCredentials(t)
+
+	// The credentials are invalidated while the first read is in flight
+	invalidated := false
+	dynClient.PrependReactor("get", "databaseconfigs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if !invalidated {
+			invalidated = true
+			credentials.Invalidate()
+		}
+		return false, nil, nil
+	})
+
+	waitCredentials(t, credentials, "user", "secret")
+	waitCredentials(t, credentials, "user", "secret")
+	waitCredentials(t, credentials, "user", "secret")
+	// The read that raced with the invalidation was not cached, the second one was
+	if gets := countGets(dynClient); gets != 2 {
+		t.Fatalf("expected 2 reads, got %d", gets)
+	}
+}
@@ -2,6 +2,7 @@ package compositions
 
 import (
 	"context"
+	"errors"
 	types "finops-composition-definition-parser/apis"
 	"fmt"
 
@@ -16,7 +17,29 @@ import (
 	kubeHelper "finops-composition-definition-parser/internal/helpers/kube/client"
 )
 
-func GetCompositionById(compositionId string, dynClient *dynamic.DynamicClient, config *rest.Config) (*unstructured.Unstructured, *types.Reference, error) {
+// ErrCompositionCreating is returned while the composition is still being created
+var ErrCompositionCreating = errors.New("composition is creating")
+
+// GetComposition gets the composition referenced, checking that it is the one with the given id and that it is no
+// longer being created
+func GetComposition(ctx context.Context, ref *types.Reference, compositionId string, dynClient dynamic.Interface) (*unstructured.Unstructured, error) {
+	item, err := kubeHelper.GetObj(ctx, ref, dynClient)
+	if err != nil {
+		return nil, err
+	}
+	// The composition was deleted and created again with the same name
+	if string(item.GetUID()) != compositionId {
+		return nil, fmt.Errorf("composition %s %s has id %s instead of %s", ref.Name, ref.Namespace, item.GetUID(), compositionId)
+	}
+	if err := checkCreating(item, compositionId); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// GetCompositionById scans all the resources of the composition.krateo.io group for the composition with the given
+// id, for the jobs that do not carry its reference
+func GetCompositionById(compositionId string, dynClient dynamic.Interface, config *rest.Config) (*unstructured.Unstructured, *types.Reference, error) {
 	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create discovery client: %v", err)
@@ -73,12 +96,8 @@ func GetCompositionById(compositionId string, dynClient *dynamic.DynamicClient,
 			// Search for the object with matching UID
 			for _, item := range list.Items {
 				if string(item.GetUID()) == compositionId {
-					conditions, ok, err := unstructured.NestedSlice(item.Object, "status", "conditions")
-					if !ok {
-						return nil, nil, fmt.Errorf("could not get status.Reason of composition %s: %v", compositionId, err)
-					}
-					if conditions[0].(map[string]interface{})["reason"].(string) == "Creating" {
-						return nil, nil, fmt.Errorf("composition is creating")
+					if err := checkCreating(&item, compositionId); err != nil {
+						return nil, nil, err
 					}
 					ref := &types.Reference{
 						ApiVersion: item.GetAPIVersion(),
@@ -97,6 +116,18 @@ func GetCompositionById(compositionId string, dynClient *dynamic.DynamicClient,
 	return nil, nil, fmt.Errorf("did not find composition with id %s in any version or resource type", compositionId)
 }
 
+// checkCreating returns ErrCompositionCreating if the first condition of the composition reports it is creating
+func checkCreating(item *unstructured.Unstructured, compositionId string) error {
+	conditions, ok, err := unstructured.NestedSlice(item.Object, "status", "conditions")
+	if !ok || len(conditions) == 0 {
+		return fmt.Errorf("could not get status.Reason of composition %s: %v", compositionId, err)
+	}
+	if condition, ok := conditions[0].(map[string]interface{}); ok && condition["reason"] == "Creating" {
+		return ErrCompositionCreating
+	}
+	return nil
+}
+
 // Helper function to check if a string slice contains a specific string
 func containsString(slice []string, s string) bool {
 	for _, item := range slice {
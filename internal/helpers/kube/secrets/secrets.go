@@ -2,30 +2,133 @@ package secrets
 
 import (
 	"context"
+	"fmt"
 
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/client-go/kubernetes/scheme"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 
 	rtv1 "github.com/krateoplatformops/provider-runtime/apis/common/v1"
 )
 
-func Get(ctx context.Context, rc *rest.Config, sel *rtv1.SecretKeySelector) (*corev1.Secret, error) {
-	rc.GroupVersion = &corev1.SchemeGroupVersion
-	rc.APIPath = "/api"
-	rc.NegotiatedSerializer = scheme.Codecs.WithoutConversion()
+// Options configures the Secrets accessor
+type Options struct {
+	// Namespace restricts the accessor to the Secrets of a single namespace, all namespaces if empty
+	Namespace string
+	// Informer serves the Secrets from an informer cache once Start has synced it, instead of calling the
+	// API server for each read. The service account then needs list and watch permissions on the Secrets
+	Informer bool
+}
+
+// Accessor reads Secrets with a typed client. It is built once and safe for concurrent use
+type Accessor struct {
+	client    kubernetes.Interface
+	namespace string
+
+	factory informers.SharedInformerFactory
+	lister  corev1listers.SecretLister
+	synced  cache.InformerSynced
+}
+
+// NewAccessor creates an accessor from a copy of the rest config, so that the config shared with the other
+// clients is left untouched
+func NewAccessor(rc *rest.Config, options Options) (*Accessor, error) {
+	config := rest.CopyConfig(rc)
+	config.UserAgent = rest.DefaultKubernetesUserAgent()
 
-	cli, err := rest.RESTClientFor(rc)
+	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
+		return nil, fmt.Errorf("error creating secrets client: %w", err)
+	}
+	return NewAccessorForClient(client, options), nil
+}
+
+// NewAccessorForClient creates an accessor using the given clientset
+func NewAccessorForClient(client kubernetes.Interface, options Options) *Accessor {
+	a := &Accessor{
+		client:    client,
+		namespace: options.Namespace,
+	}
+	if options.Informer {
+		a.factory = informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithNamespace(options.Namespace))
+		informer := a.factory.Core().V1().Secrets()
+		a.lister = informer.Lister()
+		a.synced = informer.Informer().HasSynced
+	}
+	return a
+}
+
+// Start starts the informer, if enabled, and waits for its cache to sync. The informer stops with the context
+func (a *Accessor) Start(ctx context.Context) error {
+	if a.factory == nil {
+		return nil
+	}
+	a.factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), a.synced) {
+		return fmt.Errorf("timed out waiting for the secrets informer cache to sync")
+	}
+	return nil
+}
+
+// Get returns the Secret referenced by the selector, from the informer cache once synced. The returned Secret
+// must not be modified
+func (a *Accessor) Get(ctx context.Context, sel *rtv1.SecretKeySelector) (*corev1.Secret, error) {
+	if err := a.check(sel); err != nil {
 		return nil, err
 	}
 
-	res := &corev1.Secret{}
-	err = cli.Get().
-		Resource("secrets").
-		Namespace(sel.Namespace).Name(sel.Name).
-		Do(ctx).
-		Into(res)
+	// The API server is called until the informer cache is synced
+	if a.lister != nil && a.synced() {
+		return a.lister.Secrets(sel.Namespace).Get(sel.Name)
+	}
+	return a.client.CoreV1().Secrets(sel.Namespace).Get(ctx, sel.Name, metav1.GetOptions{})
+}
 
-	return res, err
+// Fetch returns the Secret referenced by the selector from the API server, bypassing the informer cache, e.g.
+// right after a watch reported a change the cache may not have seen yet
+func (a *Accessor) Fetch(ctx context.Context, sel *rtv1.SecretKeySelector) (*corev1.Secret, error) {
+	if err := a.check(sel); err != nil {
+		return nil, err
+	}
+	return a.client.CoreV1().Secrets(sel.Namespace).Get(ctx, sel.Name, metav1.GetOptions{})
+}
+
+// Value returns the value of the key of the Secret referenced by the selector
+func (a *Accessor) Value(ctx context.Context, sel *rtv1.SecretKeySelector) (string, error) {
+	secret, err := a.Get(ctx, sel)
+	if err != nil {
+		return "", err
+	}
+	return value(secret, sel)
+}
+
+// FetchValue returns the value of the key of the Secret referenced by the selector, read from the API server
+func (a *Accessor) FetchValue(ctx context.Context, sel *rtv1.SecretKeySelector) (string, error) {
+	secret, err := a.Fetch(ctx, sel)
+	if err != nil {
+		return "", err
+	}
+	return value(secret, sel)
+}
+
+func (a *Accessor) check(sel *rtv1.SecretKeySelector) error {
+	if sel == nil {
+		return fmt.Errorf("secret selector cannot be nil")
+	}
+	if a.namespace != "" && sel.Namespace != a.namespace {
+		return fmt.Errorf("secret %s in namespace %s is outside of namespace %s", sel.Name, sel.Namespace, a.namespace)
+	}
+	return nil
+}
+
+func value(secret *corev1.Secret, sel *rtv1.SecretKeySelector) (string, error) {
+	value, ok := secret.Data[sel.Key]
+	if !ok {
+		return "", fmt.Errorf("key %s not found in secret %s in namespace %s", sel.Key, sel.Name, sel.Namespace)
+	}
+	return string(value), nil
 }
@@ -0,0 +1,107 @@
+package secrets
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+
+	rtv1 "github.com/krateoplatformops/provider-runtime/apis/common/v1"
+)
+
+func testSecret(namespace, password string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: namespace},
+		Data:       map[string][]byte{"password": []byte(password)},
+	}
+}
+
+func selector(namespace, key string) *rtv1.SecretKeySelector {
+	return &rtv1.SecretKeySelector{
+		Reference: rtv1.Reference{Name: "credentials", Namespace: namespace},
+		Key:       key,
+	}
+}
+
+func TestAccessorValue(t *testing.T) {
+	client := fake.NewSimpleClientset(testSecret("finops", "secret"), testSecret("other", "other"))
+	accessor := NewAccessorForClient(client, Options{})
+
+	ctx := context.Background()
+	value, err := accessor.Value(ctx, selector("finops", "password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "secret" {
+		t.Fatalf("expected the password of the secret, got %q", value)
+	}
+	if _, err := accessor.Value(ctx, selector("finops", "missing")); err == nil {
+		t.Fatal("expected an error for a missing key")
+	}
+	if _, err := accessor.Value(ctx, selector("missing", "password")); err == nil {
+		t.Fatal("expected an error for a missing secret")
+	}
+}
+
+func TestAccessorNamespace(t *testing.T) {
+	client := fake.NewSimpleClientset(testSecret("finops", "secret"), testSecret("other", "other"))
+	accessor := NewAccessorForClient(client, Options{Namespace: "finops"})
+
+	ctx := context.Background()
+	if _, err := accessor.Value(ctx, selector("finops", "password")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accessor.Value(ctx, selector("other", "password")); err == nil {
+		t.Fatal("expected the secret outside of the namespace to be rejected")
+	}
+}
+
+func TestAccessorInformer(t *testing.T) {
+	client := fake.NewSimpleClientset(testSecret("finops", "secret"))
+	accessor := NewAccessorForClient(client, Options{Namespace: "finops", Informer: true})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := accessor.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	value, err := accessor.Value(ctx, selector("finops", "password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "secret" {
+		t.Fatalf("expected the password of the secret, got %q", value)
+	}
+
+	// A rotated password is fetched right away, and reaches the cache through the watch
+	if _, err := client.CoreV1().Secrets("finops").Update(ctx, testSecret("finops", "rotated"), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if fetched, err := accessor.FetchValue(ctx, selector("finops", "password")); err != nil || fetched != "rotated" {
+		t.Fatalf("expected the rotated password from the API server, got %q: %v", fetched, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for value != "rotated" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the rotated password, got %q", value)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if value, err = accessor.Value(ctx, selector("finops", "password")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNewAccessorCopiesConfig(t *testing.T) {
+	rc := &rest.Config{Host: "https://kubernetes.default.svc"}
+	if _, err := NewAccessor(rc, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if rc.GroupVersion != nil || rc.APIPath != "" || rc.NegotiatedSerializer != nil || rc.UserAgent != "" {
+		t.Fatalf("expected the rest config to be left untouched, got %+v", rc)
+	}
+}
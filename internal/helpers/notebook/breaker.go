@@ -0,0 +1,68 @@
+package http
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// breaker opens after threshold consecutive failed calls, each counted once its retries are exhausted, and
+// then fails fast for the cooldown. After the cooldown a single trial request is let through: its success
+// closes the breaker, its failure opens it again
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+// allow reports whether a request can be sent, and whether it is the trial request of an open breaker
+func (b *breaker) allow() (bool, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.failures < b.threshold {
+		return true, false
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false, false
+	}
+	b.trial = true
+	return true, true
+}
+
+func (b *breaker) success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.failures >= b.threshold {
+		log.Info().Msg("notebook circuit breaker closed")
+	}
+	b.failures = 0
+	b.trial = false
+}
+
+// release lets another trial request through, without counting the outcome of the current one
+func (b *breaker) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.trial = false
+}
+
+func (b *breaker) failure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			log.Warn().Msgf("notebook circuit breaker opened after %d consecutive failures", b.failures)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
@@ -2,47 +2,497 @@ package http
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
-func CallNotebook(webserviceUrl string, operation string, compositionDefinitionId string, jsonObject []byte, annotationTable string, dbUsername string, dbPassword string) error {
+// Options configures the client of the database handler notebook, zero values use the defaults
+type Options struct {
+	// Timeout bounds each attempt, including the read of the response
+	Timeout time.Duration
+	// MaxRetries is the number of retries of the connection errors and 5xx responses, negative disables them
+	MaxRetries int
+	// RetryMinBackoff and RetryMaxBackoff bound the jittered exponential backoff between the retries
+	RetryMinBackoff time.Duration
+	RetryMaxBackoff time.Duration
+	// BreakerThreshold is the number of consecutive failed calls opening the circuit breaker, a call failing
+	// once its retries are exhausted
+	BreakerThreshold int
+	// BreakerCooldown is how long the breaker fails fast before letting a trial request through
+	BreakerCooldown time.Duration
+	// CAFile is a PEM bundle trusted in addition to the system roots
+	CAFile string
+	// CertFile and KeyFile are the PEM client certificate and key for mutual TLS
+	CertFile string
+	KeyFile  string
+	// VerifyWrites reads the table back after each create and delete, to check that it was applied
+	VerifyWrites bool
+	// VerifyAttempts and VerifyDelay bound the reads of a verification
+	VerifyAttempts int
+	VerifyDelay    time.Duration
+}
+
+// DefaultOptions are used for the options not set
+var DefaultOptions = Options{
+	Timeout:          30 * time.Second,
+	MaxRetries:       3,
+	RetryMinBackoff:  500 * time.Millisecond,
+	RetryMaxBackoff:  10 * time.Second,
+	BreakerThreshold: 5,
+	BreakerCooldown:  30 * time.Second,
+	VerifyAttempts:   5,
+	VerifyDelay:      time.Second,
+}
+
+// ErrCircuitOpen is returned without calling the notebook while the circuit breaker is open
+var ErrCircuitOpen = errors.New("notebook circuit breaker is open")
+
+// StatusError is returned for the non-200 responses of the notebook
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server returned non-200 status code: %d, body: %s", e.StatusCode, e.Body)
+}
+
+// Client calls the notebook of the database handler, retrying the transient failures and failing fast
+// while the handler is down
+type Client struct {
+	Url     string
+	options Options
+	http    *http.Client
+	breaker *breaker
+}
+
+// NewClient creates a client for the notebook at url
+func NewClient(url string, options Options) (*Client, error) {
+	options = options.withDefaults()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if options.CAFile != "" || options.CertFile != "" || options.KeyFile != "" {
+		tlsConfig, err := options.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &Client{
+		Url:     url,
+		options: options,
+		http:    &http.Client{Timeout: options.Timeout, Transport: transport},
+		breaker: &breaker{threshold: options.BreakerThreshold, cooldown: options.BreakerCooldown},
+	}, nil
+}
+
+func (o Options) withDefaults() Options {
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultOptions.Timeout
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = DefaultOptions.MaxRetries
+	}
+	if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	if o.RetryMinBackoff <= 0 {
+		o.RetryMinBackoff = DefaultOptions.RetryMinBackoff
+	}
+	if o.RetryMaxBackoff <= 0 {
+		o.RetryMaxBackoff = DefaultOptions.RetryMaxBackoff
+	}
+	if o.BreakerThreshold <= 0 {
+		o.BreakerThreshold = DefaultOptions.BreakerThreshold
+	}
+	if o.BreakerCooldown <= 0 {
+		o.BreakerCooldown = DefaultOptions.BreakerCooldown
+	}
+	if o.VerifyAttempts <= 0 {
+		o.VerifyAttempts = DefaultOptions.VerifyAttempts
+	}
+	if o.VerifyDelay <= 0 {
+		o.VerifyDelay = DefaultOptions.VerifyDelay
+	}
+	return o
+}
+
+// tlsConfig trusts the custom CA and presents the client certificate, if configured
+func (o Options) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if o.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		ca, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading notebook CA file: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in notebook CA file %s", o.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, fmt.Errorf("both the notebook client certificate and key are needed for mutual TLS")
+		}
+		certificate, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading notebook client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// Request is a call of the notebook with an operation on the row of a composition id
+type Request struct {
+	Operation     string
+	CompositionId string
+	// Keys, Provenance and Profiles are the JSON objects stored in the row, sent as "{}" if empty
+	Keys       []byte
+	Provenance []byte
+	Profiles   []byte
+	// ChartVersion is sent as "none" if empty, the Fingerprint is only sent if set
+	ChartVersion string
+	Fingerprint  string
+	Table        string
+	// Username and Password are the database credentials the notebook connects with
+	Username string
+	Password string
+}
+
+// withDefaults returns the request with the values the notebook expects for the empty arguments
+func (r Request) withDefaults() Request {
+	for _, object := range []*[]byte{&r.Keys, &r.Provenance, &r.Profiles} {
+		if len(*object) == 0 {
+			*object = []byte("{}")
+		}
+	}
+	if r.ChartVersion == "" {
+		r.ChartVersion = "none"
+	}
+	return r
+}
+
+// parameters returns the arguments of the notebook
+func (r Request) parameters() map[string]string {
+	r = r.withDefaults()
 	parameters := map[string]string{
-		"operation":        operation,
-		"composition_id":   compositionDefinitionId,
-		"json_list":        string(jsonObject),
-		"annotation_table": annotationTable,
+		"operation":        r.Operation,
+		"composition_id":   r.CompositionId,
+		"json_list":        string(r.Keys),
+		"provenance":       string(r.Provenance),
+		"profiles":         string(r.Profiles),
+		"chart_version":    r.ChartVersion,
+		"annotation_table": r.Table,
+	}
+	// Previous versions of the notebook ignore the fingerprint
+	if r.Fingerprint != "" {
+		parameters["fingerprint"] = r.Fingerprint
+	}
+	return parameters
+}
+
+// CallNotebook calls the notebook with the operation of the request on the row of its composition id
+func (c *Client) CallNotebook(ctx context.Context, request Request) error {
+	request = request.withDefaults()
+	body, err := c.post(ctx, request.parameters(), request.Username, request.Password)
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Msgf("Notebook call response body: %s", string(body))
+	if err := checkOutput(notebookOutput(body)); err != nil {
+		return err
+	}
+
+	if c.options.VerifyWrites && (request.Operation == "create" || request.Operation == "delete") {
+		return c.verify(ctx, request)
+	}
+	return nil
+}
+
+// verify reads the row of the composition id back until the write is visible, the database may make the
+// writes visible to the searches only after a refresh. A created row must hold the keys, chart version and
+// fingerprint just written, so that an update is not verified by the previous version of the row
+func (c *Client) verify(ctx context.Context, request Request) error {
+	var keys any
+	if request.Operation == "create" {
+		if err := json.Unmarshal(request.Keys, &keys); err != nil {
+			return fmt.Errorf("%w: error unmarshaling keys: %v", ErrVerification, err)
+		}
+	}
+
+	var last string
+	for attempt := 0; attempt < c.options.VerifyAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(c.options.VerifyDelay):
+			}
+		}
+
+		row, found, err := c.GetNotebook(ctx, request.CompositionId, request.Table, request.Username, request.Password)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrVerification, err)
+		}
+		switch {
+		case request.Operation == "delete" && !found:
+			return nil
+		case request.Operation == "delete":
+			last = "the row is still stored"
+		case !found:
+			last = "the row is not stored"
+		case row.ChartVersion != request.ChartVersion:
+			last = fmt.Sprintf("chart version %s is stored instead of %s", row.ChartVersion, request.ChartVersion)
+		case row.Fingerprint != request.Fingerprint:
+			last = fmt.Sprintf("fingerprint %s is stored instead of %s", row.Fingerprint, request.Fingerprint)
+		case !reflect.DeepEqual(row.Keys, keys):
+			last = "different keys are stored"
+		default:
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s of %s in %s not visible after %d reads, %s", ErrVerification, request.Operation, request.CompositionId, request.Table, c.options.VerifyAttempts, last)
+}
+
+// StoredRow is a row of a table, as printed by the 'get' operation
+type StoredRow struct {
+	CompositionId string `json:"composition_id"`
+	Keys          any    `json:"keys"`
+	ChartVersion  string `json:"chart_version"`
+	Fingerprint   string `json:"fingerprint"`
+}
+
+// GetNotebook calls the notebook with the 'get' operation and returns the row of the composition id, if stored.
+// The composition id is sent in the json_list argument, while the composition_id argument is 'none': the previous
+// versions of the notebook handle the operations they do not know as a delete of the composition_id argument
+func (c *Client) GetNotebook(ctx context.Context, compositionId string, annotationTable string, dbUsername string, dbPassword string) (*StoredRow, bool, error) {
+	compositionIds, err := json.Marshal([]string{compositionId})
+	if err != nil {
+		return nil, false, fmt.Errorf("error marshaling composition ids: %v", err)
+	}
+	request := Request{Operation: "get", CompositionId: "none", Keys: compositionIds, Table: annotationTable}
+
+	body, err := c.post(ctx, request.parameters(), dbUsername, dbPassword)
+	if err != nil {
+		return nil, false, err
+	}
+
+	log.Debug().Msgf("Notebook get response body: %s", string(body))
+
+	output := notebookOutput(body)
+	if err := checkOutput(output); err != nil {
+		return nil, false, err
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "[") {
+			continue
+		}
+		rows := []StoredRow{}
+		if err := json.Unmarshal([]byte(line), &rows); err != nil {
+			continue
+		}
+		for _, row := range rows {
+			if row.CompositionId != compositionId {
+				continue
+			}
+			row.Fingerprint = rowFingerprint(row.Fingerprint)
+			return &row, true, nil
+		}
+		return nil, false, nil
+	}
+	// The previous versions of the notebook print nothing for the 'get' operation
+	return nil, false, fmt.Errorf("could not find the rows in the notebook response, the notebook may not support the 'get' operation: %s", output)
+}
+
+// ListNotebook calls the notebook with the 'list' operation and returns the composition ids stored in the table,
+// mapped to their fingerprint. The fingerprints are empty with the previous versions of the notebook, which print
+// the composition ids only
+func (c *Client) ListNotebook(ctx context.Context, annotationTable string, dbUsername string, dbPassword string) (map[string]string, error) {
+	request := Request{Operation: "list", CompositionId: "none", Table: annotationTable}
+
+	body, err := c.post(ctx, request.parameters(), dbUsername, dbPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().Msgf("Notebook list response body: %s", string(body))
+
+	// The notebook prints the rows as a JSON array of objects, or of composition ids in its previous versions
+	output := notebookOutput(body)
+	if err := checkOutput(output); err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "[") {
+			continue
+		}
+		rows := []listedRow{}
+		if err := json.Unmarshal([]byte(line), &rows); err == nil {
+			fingerprints := make(map[string]string, len(rows))
+			for _, row := range rows {
+				fingerprints[row.CompositionId] = rowFingerprint(row.Fingerprint)
+			}
+			return fingerprints, nil
+		}
+		compositionIds := []string{}
+		if err := json.Unmarshal([]byte(line), &compositionIds); err == nil {
+			fingerprints := make(map[string]string, len(compositionIds))
+			for _, compositionId := range compositionIds {
+				fingerprints[compositionId] = ""
+			}
+			return fingerprints, nil
+		}
 	}
+	return nil, fmt.Errorf("could not find the list of composition ids in the notebook response: %s", output)
+}
+
+// listedRow is a row printed by the 'list' operation
+type listedRow struct {
+	CompositionId string `json:"composition_id"`
+	Fingerprint   string `json:"fingerprint"`
+}
 
+// rowFingerprint returns the fingerprint of a stored row, empty when none was given: the notebook then
+// stores 'none'
+func rowFingerprint(fingerprint string) string {
+	if fingerprint == "none" {
+		return ""
+	}
+	return fingerprint
+}
+
+// post sends the parameters to the notebook, retrying the connection errors and the 5xx responses with a
+// jittered exponential backoff, unless the circuit breaker is open
+func (c *Client) post(ctx context.Context, parameters map[string]string, dbUsername string, dbPassword string) ([]byte, error) {
 	parametersJson, err := json.Marshal(parameters)
 	if err != nil {
-		return fmt.Errorf("error marshaling parameters: %v", err)
+		return nil, fmt.Errorf("error marshaling parameters: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", webserviceUrl, bytes.NewBuffer(parametersJson))
+	var lastErr error
+	for attempt := 0; attempt <= c.options.MaxRetries; attempt++ {
+		if attempt > 0 {
+			delay := c.backoff(attempt)
+			log.Debug().Err(lastErr).Msgf("retrying notebook call in %s, attempt %d", delay, attempt+1)
+			select {
+			case <-ctx.Done():
+				return nil, fmt.Errorf("%w, last error: %v", ctx.Err(), lastErr)
+			case <-time.After(delay):
+			}
+		}
+
+		allowed, trial := c.breaker.allow()
+		if !allowed {
+			if lastErr != nil {
+				return nil, fmt.Errorf("%w, last error: %v", ErrCircuitOpen, lastErr)
+			}
+			return nil, ErrCircuitOpen
+		}
+
+		body, err := c.do(ctx, parametersJson, dbUsername, dbPassword)
+		if err == nil {
+			c.breaker.success()
+			return body, nil
+		}
+		if !retryable(ctx, err) {
+			var statusError *StatusError
+			switch {
+			case ctx.Err() != nil:
+				// The call was abandoned, it tells nothing about the handler
+				c.breaker.release()
+			case errors.As(err, &statusError):
+				// The handler answered, it is up even if it rejected the request
+				c.breaker.success()
+			default:
+				c.breaker.failure()
+			}
+			return nil, err
+		}
+		if trial {
+			// The handler is still failing, the breaker opens again without waiting for the retries
+			c.breaker.failure()
+			return nil, err
+		}
+		lastErr = err
+	}
+	c.breaker.failure()
+	return nil, lastErr
+}
+
+func (c *Client) do(ctx context.Context, parametersJson []byte, dbUsername string, dbPassword string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.Url, bytes.NewBuffer(parametersJson))
 	if err != nil {
-		return fmt.Errorf("error creating request: %v", err)
+		return nil, fmt.Errorf("error creating request: %v", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.SetBasicAuth(dbUsername, dbPassword)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.http.Do(req)
 	if err != nil {
-		return fmt.Errorf("error sending request: %v", err)
+		return nil, fmt.Errorf("error sending request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	body, _ := io.ReadAll(resp.Body)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %w", err)
+	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("server returned non-200 status code: %d, body: %s", resp.StatusCode, string(body))
+		return nil, &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
-	log.Info().Msgf("Notebook call response body: %s", string(body))
+	return body, nil
+}
 
-	return nil
+// retryable reports whether the failure is transient: connection errors and 5xx or 429 responses, unless
+// the context of the call is done
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var statusError *StatusError
+	if errors.As(err, &statusError) {
+		return statusError.StatusCode >= 500 || statusError.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// backoff returns a random delay up to the exponential backoff of the retry, so that clients do not retry
+// in lockstep
+func (c *Client) backoff(attempt int) time.Duration {
+	delay := c.options.RetryMinBackoff
+	for i := 1; i < attempt && delay < c.options.RetryMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > c.options.RetryMaxBackoff {
+		delay = c.options.RetryMaxBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
 }
@@ -0,0 +1,235 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testOptions() Options {
+	return Options{
+		Timeout:          time.Second,
+		MaxRetries:       2,
+		RetryMinBackoff:  time.Millisecond,
+		RetryMaxBackoff:  time.Millisecond,
+		BreakerThreshold: 3,
+		BreakerCooldown:  time.Hour,
+	}
+}
+
+func TestClientRetriesTransientFailures(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CallNotebook(context.Background(), Request{Operation: "create", CompositionId: "uid", ChartVersion: "1.0.0", Table: "table", Username: "user", Password: "pass"}); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls.Load())
+	}
+}
+
+func TestClientDoesNotRetryClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.CallNotebook(context.Background(), Request{Operation: "create", CompositionId: "uid", ChartVersion: "1.0.0", Table: "table", Username: "user", Password: "pass"})
+	var statusError *StatusError
+	if !errors.As(err, &statusError) || statusError.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a 400 status error, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected a single call, got %d", calls.Load())
+	}
+}
+
+func TestClientCircuitBreaker(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := client.CallNotebook(ctx, Request{Operation: "delete", CompositionId: "uid", Table: "table", Username: "user", Password: "pass"}); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected call %d to fail after its retries, got %v", i+1, err)
+		}
+	}
+	if calls.Load() != 9 {
+		t.Fatalf("expected 3 attempts for each call, got %d", calls.Load())
+	}
+
+	// The breaker opened after 3 consecutive failed calls, the next call fails fast
+	err = client.CallNotebook(ctx, Request{Operation: "delete", CompositionId: "uid", Table: "table", Username: "user", Password: "pass"})
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the circuit breaker to be open, got %v", err)
+	}
+	if calls.Load() != 9 {
+		t.Fatalf("expected no call while the breaker is open, got %d", calls.Load())
+	}
+
+	// After the cooldown, a single trial attempt is let through and its failure opens the breaker again
+	client.breaker.cooldown = 0
+	client.breaker.openUntil = time.Time{}
+	if err := client.CallNotebook(ctx, Request{Operation: "delete", CompositionId: "uid", Table: "table", Username: "user", Password: "pass"}); err == nil {
+		t.Fatal("expected the trial call to fail")
+	}
+	if calls.Load() != 10 {
+		t.Fatalf("expected a single trial attempt, got %d", calls.Load()-9)
+	}
+}
+
+func TestClientCustomCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`["uid"]`))
+	}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	options := testOptions()
+	options.MaxRetries = -1
+	untrusted, err := NewClient(server.URL, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := untrusted.ListNotebook(context.Background(), "table", "user", "pass"); err == nil {
+		t.Fatal("expected the server certificate to be rejected without the CA")
+	}
+
+	options.CAFile = caFile
+	trusted, err := NewClient(server.URL, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprints, err := trusted.ListNotebook(context.Background(), "table", "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fingerprints["uid"]; len(fingerprints) != 1 || !ok {
+		t.Fatalf("unexpected composition ids: %v", fingerprints)
+	}
+}
+
+func TestClientNotebookErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`"Could not complete create for uid in table table: relation unknown\n"`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.CallNotebook(context.Background(), Request{Operation: "create", CompositionId: "uid", ChartVersion: "1.0.0", Table: "table", Username: "user", Password: "pass"})
+	var notebookError *NotebookError
+	if !errors.Is(err, ErrOperation) || !errors.As(err, &notebookError) {
+		t.Fatalf("expected a notebook operation error, got %v", err)
+	}
+	if notebookError.Message != "Could not complete create for uid in table table: relation unknown" {
+		t.Fatalf("unexpected message: %q", notebookError.Message)
+	}
+
+	if _, err := client.ListNotebook(context.Background(), "table", "user", "pass"); !errors.Is(err, ErrOperation) {
+		t.Fatalf("expected a notebook operation error from the list, got %v", err)
+	}
+}
+
+func TestClientVerifyWrites(t *testing.T) {
+	var gets atomic.Int32
+	var stored atomic.Value
+	stored.Store("[]")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parameters := map[string]string{}
+		if err := json.NewDecoder(r.Body).Decode(&parameters); err != nil {
+			t.Error(err)
+		}
+		if parameters["operation"] != "get" {
+			return
+		}
+		// A previous notebook would delete the composition_id argument of an unknown operation
+		if parameters["composition_id"] != "none" || parameters["json_list"] != `["uid"]` {
+			t.Errorf("unexpected get parameters: %v", parameters)
+		}
+		// The new row becomes visible only from the second read, as before a refresh of the table
+		if gets.Add(1) < 2 {
+			w.Write([]byte(`[{"composition_id": "uid", "keys": {"Standard_B1s": 1}, "chart_version": "1.0.0", "fingerprint": "none"}]` + "\n"))
+			return
+		}
+		w.Write([]byte(stored.Load().(string) + "\n"))
+	}))
+	defer server.Close()
+
+	options := testOptions()
+	options.VerifyWrites = true
+	options.VerifyAttempts = 3
+	options.VerifyDelay = time.Millisecond
+	client, err := NewClient(server.URL, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	stored.Store(`[{"composition_id": "uid", "keys": {"Standard_B1s": 2}, "chart_version": "1.1.0", "fingerprint": "f1"}]`)
+	if err := client.CallNotebook(ctx, Request{Operation: "create", CompositionId: "uid", Keys: []byte(`{"Standard_B1s": 2}`), ChartVersion: "1.1.0", Fingerprint: "f1", Table: "table", Username: "user", Password: "pass"}); err != nil {
+		t.Fatal(err)
+	}
+	if gets.Load() != 2 {
+		t.Fatalf("expected 2 reads, got %d", gets.Load())
+	}
+
+	// The update is never applied, the previous version of the row does not verify it
+	gets.Store(0)
+	stored.Store(`[{"composition_id": "uid", "keys": {"Standard_B1s": 1}, "chart_version": "1.0.0", "fingerprint": "none"}]`)
+	err = client.CallNotebook(ctx, Request{Operation: "create", CompositionId: "uid", Keys: []byte(`{"Standard_B1s": 2}`), ChartVersion: "1.1.0", Fingerprint: "f1", Table: "table", Username: "user", Password: "pass"})
+	if !errors.Is(err, ErrVerification) {
+		t.Fatalf("expected a verification error, got %v", err)
+	}
+
+	// The row is never deleted
+	err = client.CallNotebook(ctx, Request{Operation: "delete", CompositionId: "uid", Table: "table", Username: "user", Password: "pass"})
+	if !errors.Is(err, ErrVerification) {
+		t.Fatalf("expected a verification error, got %v", err)
+	}
+
+	// The row is deleted
+	stored.Store("[]")
+	if err := client.CallNotebook(ctx, Request{Operation: "delete", CompositionId: "uid", Table: "table", Username: "user", Password: "pass"}); err != nil {
+		t.Fatal(err)
+	}
+}
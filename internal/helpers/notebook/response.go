@@ -0,0 +1,75 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors reported by the notebook in its output, while the handler still answers 200
+var (
+	// ErrTableCreation is reported when the notebook could not create the annotation table
+	ErrTableCreation = errors.New("notebook could not create the table")
+	// ErrOperation is reported when the notebook could not complete the create, delete or list
+	ErrOperation = errors.New("notebook could not complete the operation")
+	// ErrMissingArgument is reported when the notebook did not receive one of its arguments
+	ErrMissingArgument = errors.New("notebook is missing an argument")
+	// ErrException is reported when the notebook raised an exception it did not catch
+	ErrException = errors.New("notebook raised an exception")
+	// ErrVerification is returned when the write cannot be read back after the notebook reported a success
+	ErrVerification = errors.New("notebook write could not be verified")
+)
+
+// NotebookError is an error found in the output of the notebook. It wraps one of the Err variables, so
+// that it can be checked with errors.Is
+type NotebookError struct {
+	Err error
+	// Message is the line of the output reporting the error
+	Message string
+	// Output is the whole output of the notebook
+	Output string
+}
+
+func (e *NotebookError) Error() string {
+	return fmt.Sprintf("%v: %s", e.Err, e.Message)
+}
+
+func (e *NotebookError) Unwrap() error {
+	return e.Err
+}
+
+// outputPrefixes maps the beginning of the lines printed by the notebook to the error they report
+var outputPrefixes = []struct {
+	prefix string
+	err    error
+}{
+	{"Could not create table", ErrTableCreation},
+	{"Could not complete", ErrOperation},
+	{"missing agument for call", ErrMissingArgument},
+	{"missing argument for call", ErrMissingArgument},
+	{"Traceback (most recent call last)", ErrException},
+}
+
+// notebookOutput returns the output of the notebook from the response body of the handler, which is either
+// the raw output or the output as a JSON string
+func notebookOutput(body []byte) string {
+	var output string
+	if err := json.Unmarshal(body, &output); err == nil {
+		return output
+	}
+	return string(body)
+}
+
+// checkOutput returns the first error reported in the output of the notebook, if any
+func checkOutput(output string) error {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		for _, outputPrefix := range outputPrefixes {
+			if strings.HasPrefix(line, outputPrefix.prefix) {
+				return &NotebookError{Err: outputPrefix.err, Message: line, Output: output}
+			}
+		}
+	}
+	return nil
+}
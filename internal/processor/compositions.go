@@ -0,0 +1,130 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	coreprovider "github.com/krateoplatformops/core-provider/apis/compositiondefinitions/v1alpha1"
+
+	types "finops-composition-definition-parser/apis"
+	kubeHelper "finops-composition-definition-parser/internal/helpers/kube/client"
+	compositionsHelper "finops-composition-definition-parser/internal/helpers/kube/compositions"
+)
+
+// CreateComposition stores the annotations found in the chart of a composition instance, rendered with the
+// spec of the instance as values, so that the stored keys are the ones the instance actually deploys.
+// Compositions that are still being created return an error, so that they are retried later. The composition is
+// read through its reference, if given, instead of scanning all the compositions for its id
+func (p *Processor) CreateComposition(ctx context.Context, reference *types.Reference, compositionId string) error {
+	var composition *unstructured.Unstructured
+	var err error
+	if reference != nil {
+		composition, err = compositionsHelper.GetComposition(ctx, reference, compositionId, p.DynClient)
+	} else {
+		composition, _, err = compositionsHelper.GetCompositionById(compositionId, p.DynClient, p.Config)
+	}
+	if err != nil {
+		return fmt.Errorf("error while retrieving composition: %w", err)
+	}
+
+	definition, err := p.compositionDefinitionOf(ctx, composition)
+	if err != nil {
+		return err
+	}
+
+	// The spec of a composition holds the values of its chart
+	values, _, err := unstructured.NestedMap(composition.Object, "spec")
+	if err != nil {
+		return fmt.Errorf("error while reading spec of composition %s: %w", compositionId, err)
+	}
+
+	process, cleanup, err := p.chartProcessor(definition.Spec.Chart)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	opts := p.processOptions(values)
+	opts.ReleaseName = composition.GetName()
+	opts.ReleaseNamespace = composition.GetNamespace()
+	results, err := process(opts)
+	if err != nil {
+		return fmt.Errorf("error while processing chart of composition %s: %w", compositionId, err)
+	}
+
+	var errs []error
+	for _, mapping := range p.Mappings {
+		if mapping.CompositionTable == "" {
+			continue
+		}
+
+		result := results[mapping.Label]
+		logEntryErrors(compositionId, mapping.Label, "", result)
+
+		chartVersion := result.ChartVersion
+		if chartVersion == "" {
+			chartVersion = definition.Spec.Chart.Version
+		}
+
+		if err := p.store(ctx, compositionId, mapping.CompositionTable, result, nil, chartVersion, ""); err != nil {
+			errs = append(errs, fmt.Errorf("error while storing %s annotations: %w", mapping.Label, err))
+			continue
+		}
+		log.Info().Msgf("stored %s annotations for composition %s %s in %s, chart version %s", mapping.Label, composition.GetName(), composition.GetNamespace(), mapping.CompositionTable, chartVersion)
+	}
+	return errors.Join(errs...)
+}
+
+// DeleteComposition removes the annotations stored for the composition instance from the composition tables
+func (p *Processor) DeleteComposition(ctx context.Context, compositionId string) error {
+	var errs []error
+	for _, mapping := range p.Mappings {
+		if mapping.CompositionTable == "" {
+			continue
+		}
+		if err := p.Sink.Delete(ctx, mapping.CompositionTable, compositionId); err != nil {
+			errs = append(errs, fmt.Errorf("error while deleting from %s: %w", mapping.CompositionTable, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	log.Info().Msgf("deleted annotations for composition %s", compositionId)
+	return nil
+}
+
+// compositionDefinitionOf finds the composition definition that generated the kind of the composition,
+// i.e. the one whose status reports the apiVersion and kind of the composition
+func (p *Processor) compositionDefinitionOf(ctx context.Context, composition *unstructured.Unstructured) (*coreprovider.CompositionDefinition, error) {
+	list, err := p.DynClient.Resource(kubeHelper.CompositionDefinitionResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing composition definitions: %w", err)
+	}
+
+	for i := range list.Items {
+		item := &list.Items[i]
+		apiVersion, _, _ := unstructured.NestedString(item.Object, "status", "apiVersion")
+		kind, _, _ := unstructured.NestedString(item.Object, "status", "kind")
+		if apiVersion != composition.GetAPIVersion() || kind != composition.GetKind() {
+			continue
+		}
+
+		definition := &coreprovider.CompositionDefinition{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, definition); err != nil {
+			return nil, fmt.Errorf("error while converting from unstructured to composition definition: %w", err)
+		}
+		if definition.Spec.Chart == nil {
+			return nil, fmt.Errorf("composition definition %s %s has no chart", definition.Namespace, definition.Name)
+		}
+		return definition, nil
+	}
+	return nil, fmt.Errorf("no composition definition found for %s %s", composition.GetAPIVersion(), composition.GetKind())
+}
@@ -0,0 +1,414 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+
+	coreprovider "github.com/krateoplatformops/core-provider/apis/compositiondefinitions/v1alpha1"
+
+	types "finops-composition-definition-parser/apis"
+	chartHelper "finops-composition-definition-parser/internal/helpers/chart"
+	kubeHelper "finops-composition-definition-parser/internal/helpers/kube/client"
+	secretsHelper "finops-composition-definition-parser/internal/helpers/kube/secrets"
+	"finops-composition-definition-parser/internal/sink"
+)
+
+// Processor extracts the finops annotations from the chart of composition definitions and
+// stores them in the configured sink
+type Processor struct {
+	Config    *rest.Config
+	DynClient dynamic.Interface
+	// Secrets reads the credentials of the chart repositories
+	Secrets *secretsHelper.Accessor
+	// Sink stores the annotations found, by composition id
+	Sink sink.Sink
+
+	// Mappings lists the annotation labels to extract, each one with the tables storing its resources. All the
+	// labels are extracted from the same chart processing
+	Mappings []types.AnnotationMapping
+
+	// WorkingDirectory is the base path where each job creates its own temporary directory to extract the chart
+	WorkingDirectory string
+	// ExtractLimits bounds the size of the chart archives extracted in the working directory or loaded in memory
+	ExtractLimits chartHelper.ExtractLimits
+	// InMemory loads the chart archive in memory instead of extracting it in the working directory
+	InMemory bool
+	// FetchDependencies downloads the chart dependencies that are not vendored in the chart archive
+	FetchDependencies bool
+	// ProfilesNamespaces lists the namespaces, besides the one of each composition definition, from which
+	// the ConfigMaps of the values profiles can be read
+	ProfilesNamespaces []string
+
+	// processed maps the composition definition ids to the fingerprint of the last chart successfully processed,
+	// initialized with the fingerprints stored in the sink once loaded
+	processed       map[string]string
+	processedLoaded bool
+	processedMutex  sync.Mutex
+}
+
+// ChartFingerprint identifies the chart of a composition definition, to detect when it changes
+func ChartFingerprint(chart *coreprovider.ChartInfo) string {
+	if chart == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s|%s|%s", chart.Url, chart.Repo, chart.Version)
+}
+
+// LastProcessed returns the fingerprint of the last chart successfully processed for the composition definition.
+// The fingerprints stored in the sink are loaded on first use, so that the composition definitions processed
+// before a restart are not processed again
+func (p *Processor) LastProcessed(ctx context.Context, compositionId string) (string, bool) {
+	p.processedMutex.Lock()
+	defer p.processedMutex.Unlock()
+
+	if !p.processedLoaded {
+		stored, err := p.List(ctx)
+		if err != nil {
+			log.Warn().Err(err).Msg("could not load the stored fingerprints, retrying on the next update")
+		} else {
+			if p.processed == nil {
+				p.processed = map[string]string{}
+			}
+			for storedId, fingerprint := range stored {
+				if _, ok := p.processed[storedId]; !ok && fingerprint != "" {
+					p.processed[storedId] = fingerprint
+				}
+			}
+			p.processedLoaded = true
+		}
+	}
+
+	fingerprint, ok := p.processed[compositionId]
+	return fingerprint, ok
+}
+
+func (p *Processor) setProcessed(compositionId, fingerprint string) {
+	p.processedMutex.Lock()
+	defer p.processedMutex.Unlock()
+	if p.processed == nil {
+		p.processed = map[string]string{}
+	}
+	p.processed[compositionId] = fingerprint
+}
+
+func (p *Processor) unsetProcessed(compositionId string) {
+	p.processedMutex.Lock()
+	defer p.processedMutex.Unlock()
+	delete(p.processed, compositionId)
+}
+
+// Create retrieves the composition definition referenced and stores the annotations found in its chart
+func (p *Processor) Create(ctx context.Context, composition *types.Reference, compositionId string) error {
+	compositionObjectUnstructured, err := kubeHelper.GetObj(ctx, composition, p.DynClient)
+	if err != nil {
+		return fmt.Errorf("error while retrieving object: %w", err)
+	}
+
+	if compositionId == "" {
+		compositionId = string(compositionObjectUnstructured.GetUID())
+	}
+	return p.CreateFromObject(ctx, compositionObjectUnstructured, compositionId)
+}
+
+// CreateFromObject stores the annotations found in the chart of the given composition definition, for the
+// chart defaults and for each of the values profiles attached to it
+func (p *Processor) CreateFromObject(ctx context.Context, compositionObjectUnstructured *unstructured.Unstructured, compositionId string) error {
+	compositionObject, err := compositionDefinitionFromObject(compositionObjectUnstructured)
+	if err != nil {
+		return err
+	}
+
+	profiles, fingerprint, err := p.profilesAndFingerprint(ctx, compositionObjectUnstructured)
+	if err != nil {
+		return err
+	}
+	return p.createWithProfiles(ctx, compositionObject, compositionId, profiles, fingerprint)
+}
+
+// createWithProfiles stores the annotations found in the chart of the composition definition with the values
+// profiles already loaded, and records the fingerprint once all the labels are stored
+func (p *Processor) createWithProfiles(ctx context.Context, compositionObject *coreprovider.CompositionDefinition, compositionId string, profiles Profiles, fingerprint string) error {
+	results, profileResults, err := p.extract(compositionObject.Spec.Chart, profiles)
+	if err != nil {
+		return err
+	}
+
+	// Each label is uploaded independently, a failure does not prevent the upload of the other ones
+	var errs []error
+	for _, mapping := range p.Mappings {
+		result := results[mapping.Label]
+
+		// Entries that could not be evaluated are left out of the stored keys
+		logEntryErrors(compositionId, mapping.Label, "", result)
+		profileCounts := map[string]map[string]float64{}
+		for name, profileResult := range profileResults {
+			logEntryErrors(compositionId, mapping.Label, name, profileResult[mapping.Label])
+			profileCounts[name] = profileResult[mapping.Label].Counts
+		}
+
+		// Record which chart version the stored keys correspond to
+		chartVersion := result.ChartVersion
+		if chartVersion == "" {
+			chartVersion = compositionObject.Spec.Chart.Version
+		}
+
+		if err := p.store(ctx, compositionId, mapping.Table, result, profileCounts, chartVersion, fingerprint); err != nil {
+			errs = append(errs, fmt.Errorf("error while storing %s annotations: %w", mapping.Label, err))
+			continue
+		}
+		log.Info().Msgf("stored %s annotations for composition definition %s in %s, chart version %s, %d values profiles", mapping.Label, compositionId, mapping.Table, chartVersion, len(profileResults))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	p.setProcessed(compositionId, fingerprint)
+	return nil
+}
+
+// store upserts the keys, provenance and profile keys of a single label in the given table
+func (p *Processor) store(ctx context.Context, compositionId, table string, result *chartHelper.ProcessResult, profileCounts map[string]map[string]float64, chartVersion, fingerprint string) error {
+	record := sink.Record{
+		CompositionId: compositionId,
+		Keys:          result.Counts,
+		// The provenance tells which chart manifests contributed each resource
+		Provenance: result.Provenance,
+		// The keys found with each values profile, by profile name
+		Profiles:     profileCounts,
+		ChartVersion: chartVersion,
+		Fingerprint:  fingerprint,
+	}
+	if err := p.Sink.Upsert(ctx, table, record); err != nil {
+		return fmt.Errorf("error while storing in %s: %w", table, err)
+	}
+	return nil
+}
+
+// logEntryErrors logs the annotation entries that could not be evaluated
+func logEntryErrors(compositionId, annotationLabel, profile string, result *chartHelper.ProcessResult) {
+	for _, entryError := range result.Errors {
+		log.Warn().Msgf("composition %s: %s entry %s of %s %s in %s could not be evaluated%s: %s",
+			compositionId, annotationLabel, entryError.Entry, entryError.Kind, entryError.Name, entryError.Template, profileSuffix(profile), entryError.Err)
+	}
+}
+
+// labels returns the annotation labels of the mappings
+func (p *Processor) labels() []string {
+	labels := make([]string, 0, len(p.Mappings))
+	for _, mapping := range p.Mappings {
+		labels = append(labels, mapping.Label)
+	}
+	return labels
+}
+
+func profileSuffix(profile string) string {
+	if profile == "" {
+		return ""
+	}
+	return fmt.Sprintf(" with values profile %s", profile)
+}
+
+// extract downloads the chart once and collects the annotations with the given key, either from an in-memory
+// chart or from the chart extracted in a working directory. The composition definition does not carry
+// values of its own, so the chart is processed with its defaults, then with each values profile overlaid
+func (p *Processor) extract(chartInfo *coreprovider.ChartInfo, profiles Profiles) (chartHelper.ProcessResults, map[string]chartHelper.ProcessResults, error) {
+	process, cleanup, err := p.chartProcessor(chartInfo)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cleanup()
+
+	results, err := process(p.processOptions(nil))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error while processing chart: %w", err)
+	}
+
+	profileResults := map[string]chartHelper.ProcessResults{}
+	for _, name := range profiles.names() {
+		profileResult, err := process(p.processOptions(profiles[name]))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error while processing chart with values profile %s: %w", name, err)
+		}
+		profileResults[name] = profileResult
+	}
+	return results, profileResults, nil
+}
+
+// chartProcessor downloads the chart and returns a function processing it with the given options, and a
+// function releasing the downloaded chart
+func (p *Processor) chartProcessor(chartInfo *coreprovider.ChartInfo) (func(opts chartHelper.ProcessOptions) (chartHelper.ProcessResults, error), func(), error) {
+	process, cleanup, err := p.downloadChart(chartInfo)
+	if err != nil || !p.FetchDependencies {
+		return process, cleanup, err
+	}
+
+	// The dependencies are fetched with the settings of the repository of the chart
+	repository, err := chartHelper.RepositoryFromSpec(chartInfo, p.Secrets)
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("error while retrieving chart repository: %w", err)
+	}
+	withRepository := func(opts chartHelper.ProcessOptions) (chartHelper.ProcessResults, error) {
+		opts.Repository = repository
+		return process(opts)
+	}
+	return withRepository, cleanup, nil
+}
+
+// downloadChart downloads the chart, in memory or in a working directory
+func (p *Processor) downloadChart(chartInfo *coreprovider.ChartInfo) (func(opts chartHelper.ProcessOptions) (chartHelper.ProcessResults, error), func(), error) {
+	if p.InMemory {
+		dat, err := chartHelper.ChartArchiveFromSpec(chartInfo, p.ExtractLimits, p.Secrets)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error while downloading chart: %w", err)
+		}
+
+		process := func(opts chartHelper.ProcessOptions) (chartHelper.ProcessResults, error) {
+			chrt, err := chartHelper.LoadChartArchive(dat)
+			if err != nil {
+				return nil, err
+			}
+			return chartHelper.ProcessLoadedChart(chrt, p.labels(), opts)
+		}
+		return process, func() {}, nil
+	}
+
+	// Download and extract in a directory dedicated to this job, then cleanup the download
+	workDir, err := os.MkdirTemp(p.WorkingDirectory, "chart-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error while creating working directory: %w", err)
+	}
+	cleanup := func() {
+		if err := chartHelper.CleanupDirectory(workDir); err != nil {
+			log.Error().Err(err).Msgf("error while cleaning up %s", workDir)
+		}
+	}
+
+	chartRoot, err := chartHelper.ChartInfoFromSpec(chartInfo, workDir, p.ExtractLimits, p.Secrets)
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("error while downloading and extracting chart: %w", err)
+	}
+
+	process := func(opts chartHelper.ProcessOptions) (chartHelper.ProcessResults, error) {
+		return chartHelper.ProcessHelmTemplates(chartRoot, p.labels(), opts)
+	}
+	return process, cleanup, nil
+}
+
+func (p *Processor) processOptions(values map[string]interface{}) chartHelper.ProcessOptions {
+	return chartHelper.ProcessOptions{Values: values, FetchDependencies: p.FetchDependencies, ExtractLimits: p.ExtractLimits}
+}
+
+// Update retrieves the composition definition referenced and, if its chart changed since the last
+// successful run, stores the annotations found in the new chart
+func (p *Processor) Update(ctx context.Context, composition *types.Reference, compositionId string) error {
+	compositionObjectUnstructured, err := kubeHelper.GetObj(ctx, composition, p.DynClient)
+	if err != nil {
+		return fmt.Errorf("error while retrieving object: %w", err)
+	}
+
+	if compositionId == "" {
+		compositionId = string(compositionObjectUnstructured.GetUID())
+	}
+	return p.UpdateFromObject(ctx, compositionObjectUnstructured, compositionId)
+}
+
+// UpdateFromObject stores the annotations found in the chart of the given composition definition,
+// unless the same chart with the same values profiles was already processed successfully
+func (p *Processor) UpdateFromObject(ctx context.Context, compositionObjectUnstructured *unstructured.Unstructured, compositionId string) error {
+	profiles, fingerprint, err := p.profilesAndFingerprint(ctx, compositionObjectUnstructured)
+	if err != nil {
+		return err
+	}
+
+	if lastFingerprint, ok := p.LastProcessed(ctx, compositionId); ok && lastFingerprint == fingerprint {
+		log.Debug().Msgf("chart of composition definition %s did not change, skipping", compositionId)
+		return nil
+	}
+
+	compositionObject, err := compositionDefinitionFromObject(compositionObjectUnstructured)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("chart of composition definition %s changed, upserting annotations", compositionId)
+	return p.createWithProfiles(ctx, compositionObject, compositionId, profiles, fingerprint)
+}
+
+// compositionDefinitionFromObject transforms the unstructured object into a CompositionDefinition with a chart
+func compositionDefinitionFromObject(obj *unstructured.Unstructured) (*coreprovider.CompositionDefinition, error) {
+	compositionObject := &coreprovider.CompositionDefinition{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, compositionObject); err != nil {
+		return nil, fmt.Errorf("error while converting from unstructured to composition definition: %w", err)
+	}
+	if compositionObject.Spec.Chart == nil {
+		return nil, fmt.Errorf("composition definition %s %s has no chart", compositionObject.Namespace, compositionObject.Name)
+	}
+	return compositionObject, nil
+}
+
+// chartInfoFromObject reads the chart infos of an unstructured composition definition
+func chartInfoFromObject(obj *unstructured.Unstructured) (*coreprovider.ChartInfo, error) {
+	chart, _, err := unstructured.NestedMap(obj.Object, "spec", "chart")
+	if err != nil {
+		return nil, fmt.Errorf("error while reading chart of composition definition: %w", err)
+	}
+
+	chartInfo := &coreprovider.ChartInfo{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(chart, chartInfo); err != nil {
+		return nil, fmt.Errorf("error while converting chart of composition definition: %w", err)
+	}
+	return chartInfo, nil
+}
+
+// Delete removes the annotations stored for the composition definition from the tables of all the labels
+func (p *Processor) Delete(ctx context.Context, compositionId string) error {
+	var errs []error
+	for _, mapping := range p.Mappings {
+		if err := p.Sink.Delete(ctx, mapping.Table, compositionId); err != nil {
+			errs = append(errs, fmt.Errorf("error while deleting from %s: %w", mapping.Table, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	p.unsetProcessed(compositionId)
+	log.Info().Msgf("deleted annotations for composition definition %s", compositionId)
+	return nil
+}
+
+// List returns the ids of the composition definitions stored in the tables of any of the labels, mapped to
+// their stored fingerprint. The fingerprint is empty unless the tables of all the labels store the same one
+func (p *Processor) List(ctx context.Context) (map[string]string, error) {
+	fingerprints := map[string]string{}
+	for i, mapping := range p.Mappings {
+		tableFingerprints, err := p.Sink.List(ctx, mapping.Table)
+		if err != nil {
+			return nil, fmt.Errorf("error while listing %s: %w", mapping.Table, err)
+		}
+		for compositionId, fingerprint := range tableFingerprints {
+			if previous, ok := fingerprints[compositionId]; i > 0 && (!ok || previous != fingerprint) {
+				fingerprint = ""
+			}
+			fingerprints[compositionId] = fingerprint
+		}
+		// Missing from this table, the composition definition needs to be processed again
+		for compositionId := range fingerprints {
+			if _, ok := tableFingerprints[compositionId]; !ok {
+				fingerprints[compositionId] = ""
+			}
+		}
+	}
+	return fingerprints, nil
+}
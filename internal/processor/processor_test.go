@@ -0,0 +1,173 @@
+package processor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	coreprovider "github.com/krateoplatformops/core-provider/apis/compositiondefinitions/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	types "finops-composition-definition-parser/apis"
+	kubeHelper "finops-composition-definition-parser/internal/helpers/kube/client"
+	"finops-composition-definition-parser/internal/sink"
+)
+
+func TestStoredFingerprints(t *testing.T) {
+	s, err := sink.NewFile(t.TempDir(), sink.FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, stored := range []struct {
+		table  string
+		record sink.Record
+	}{
+		{"pricing", sink.Record{CompositionId: "same", Fingerprint: "f1"}},
+		{"carbon", sink.Record{CompositionId: "same", Fingerprint: "f1"}},
+		{"pricing", sink.Record{CompositionId: "different", Fingerprint: "f1"}},
+		{"carbon", sink.Record{CompositionId: "different", Fingerprint: "f2"}},
+		{"pricing", sink.Record{CompositionId: "partial", Fingerprint: "f1"}},
+	} {
+		if err := s.Upsert(ctx, stored.table, stored.record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := &Processor{
+		Sink:     s,
+		Mappings: []types.AnnotationMapping{{Label: "pricing", Table: "pricing"}, {Label: "carbon", Table: "carbon"}},
+	}
+	fingerprints, err := p.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fingerprints) != 3 || fingerprints["same"] != "f1" || fingerprints["different"] != "" || fingerprints["partial"] != "" {
+		t.Fatalf("unexpected stored fingerprints: %v", fingerprints)
+	}
+
+	// After a restart, the fingerprints are loaded from the sink
+	if fingerprint, ok := p.LastProcessed(ctx, "same"); !ok || fingerprint != "f1" {
+		t.Fatalf("expected the stored fingerprint, got %q", fingerprint)
+	}
+	if _, ok := p.LastProcessed(ctx, "different"); ok {
+		t.Fatal("expected no fingerprint when the tables disagree")
+	}
+}
+
+func testProfilesConfigMap(resourceVersion string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": "profiles", "namespace": "krateo-system"},
+		"data":       map[string]interface{}{"small.yaml": "vm:\n  sku: Standard_B1s\n"},
+	}}
+	obj.SetResourceVersion(resourceVersion)
+	return obj
+}
+
+func TestUpdateSkipsUnchangedFingerprint(t *testing.T) {
+	// The chart downloads are counted, and fail, so that a reprocessing shows as a download and an error
+	var downloads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	compositionDefinition := func(version string, annotations map[string]string) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "core.krateo.io/v1alpha1",
+			"kind":       "CompositionDefinition",
+			"metadata":   map[string]interface{}{"name": "fireworksapp", "namespace": "krateo-system", "uid": "uid"},
+			"spec": map[string]interface{}{
+				"chart": map[string]interface{}{"url": server.URL + "/fireworks-app-" + version + ".tgz", "version": version},
+			},
+		}}
+		obj.SetAnnotations(annotations)
+		return obj
+	}
+
+	s, err := sink.NewFile(t.TempDir(), sink.FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dynClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		kubeHelper.ConfigMapResource: "ConfigMapList",
+	}, testProfilesConfigMap("1"))
+	p := &Processor{
+		DynClient: dynClient,
+		Sink:      s,
+		Mappings:  []types.AnnotationMapping{{Label: "pricing", Table: "pricing"}},
+		InMemory:  true,
+	}
+
+	ctx := context.Background()
+	annotations := map[string]string{ProfilesAnnotation: "large: {}", ProfilesConfigMapAnnotation: "profiles"}
+	stored := compositionDefinition("1.0.0", annotations)
+	fingerprint, err := p.Fingerprint(ctx, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stored before a restart, the fingerprint is loaded from the sink
+	if err := s.Upsert(ctx, "pricing", sink.Record{CompositionId: "uid", Fingerprint: fingerprint}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.UpdateFromObject(ctx, stored, "uid"); err != nil || downloads.Load() != 0 {
+		t.Fatalf("expected the unchanged composition definition to be skipped, got %d downloads and error %v", downloads.Load(), err)
+	}
+
+	tests := []struct {
+		name   string
+		obj    *unstructured.Unstructured
+		update func()
+	}{
+		{"chart version", compositionDefinition("1.1.0", annotations), func() {}},
+		{"inline profiles", compositionDefinition("1.0.0", map[string]string{ProfilesAnnotation: "medium: {}", ProfilesConfigMapAnnotation: "profiles"}), func() {}},
+		{"profiles configmap", stored, func() {
+			if _, err := dynClient.Resource(kubeHelper.ConfigMapResource).Namespace("krateo-system").Update(ctx, testProfilesConfigMap("2"), metav1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, test := range tests {
+		test.update()
+		before := downloads.Load()
+		dynClient.ClearActions()
+		if err := p.UpdateFromObject(ctx, test.obj, "uid"); err == nil || downloads.Load() == before {
+			t.Fatalf("%s: expected the changed composition definition to be processed again: %v", test.name, err)
+		}
+		// The profiles are loaded once, for both the fingerprint and the processing
+		if gets := len(dynClient.Actions()); gets != 1 {
+			t.Fatalf("%s: expected the profiles configmap to be read once, got %d reads", test.name, gets)
+		}
+	}
+}
+
+func TestDownloadChartCleanup(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	workingDirectory := t.TempDir()
+	p := &Processor{WorkingDirectory: workingDirectory}
+	if _, _, err := p.downloadChart(&coreprovider.ChartInfo{Url: server.URL + "/fireworks-app-1.0.0.tgz", Version: "1.0.0"}); err == nil {
+		t.Fatal("expected an error for a missing chart")
+	}
+
+	// The directory created for the job is removed when the download fails
+	entries, err := os.ReadDir(workingDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected the job directory to be removed, found %v", entries)
+	}
+}
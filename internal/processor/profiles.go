@@ -0,0 +1,141 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	kubeHelper "finops-composition-definition-parser/internal/helpers/kube/client"
+)
+
+const (
+	// ProfilesAnnotation holds inline values profiles, as a YAML or JSON object mapping each profile
+	// name to the values overlaid on the chart defaults
+	ProfilesAnnotation = "finops.krateo.io/values-profiles"
+	// ProfilesConfigMapAnnotation references a ConfigMap, as "name" or "namespace/name", in which each
+	// key is a profile name, optionally with a .yaml extension, and each value is a values overlay. Other
+	// namespaces than the one of the composition definition must be listed in Processor.ProfilesNamespaces
+	ProfilesConfigMapAnnotation = "finops.krateo.io/values-profiles-configmap"
+)
+
+// Profiles maps the name of each values profile to the values overlaid on the chart defaults
+type Profiles map[string]map[string]interface{}
+
+// ProfileAnnotationsChanged reports whether the values profiles attached to a composition definition changed
+func ProfileAnnotationsChanged(oldObj, newObj *unstructured.Unstructured) bool {
+	oldAnnotations := oldObj.GetAnnotations()
+	newAnnotations := newObj.GetAnnotations()
+	return oldAnnotations[ProfilesAnnotation] != newAnnotations[ProfilesAnnotation] ||
+		oldAnnotations[ProfilesConfigMapAnnotation] != newAnnotations[ProfilesConfigMapAnnotation]
+}
+
+// Fingerprint identifies the chart and the values profiles of a composition definition, to detect when
+// either of them changes. Profiles from a ConfigMap are identified by its resource version
+func (p *Processor) Fingerprint(ctx context.Context, obj *unstructured.Unstructured) (string, error) {
+	_, fingerprint, err := p.profilesAndFingerprint(ctx, obj)
+	return fingerprint, err
+}
+
+// profilesAndFingerprint loads the values profiles of the composition definition and returns them with
+// its fingerprint, so that the ConfigMap of the profiles is read once per update
+func (p *Processor) profilesAndFingerprint(ctx context.Context, obj *unstructured.Unstructured) (Profiles, string, error) {
+	chartInfo, err := chartInfoFromObject(obj)
+	if err != nil {
+		return nil, "", err
+	}
+
+	profiles, profilesFingerprint, err := p.loadProfiles(ctx, obj)
+	if err != nil {
+		return nil, "", err
+	}
+	return profiles, ChartFingerprint(chartInfo) + "|" + profilesFingerprint, nil
+}
+
+// loadProfiles reads the values profiles attached to the composition definition, either inline or from a
+// ConfigMap, and returns them together with a fingerprint of their source
+func (p *Processor) loadProfiles(ctx context.Context, obj *unstructured.Unstructured) (Profiles, string, error) {
+	annotations := obj.GetAnnotations()
+	profiles := Profiles{}
+	var fingerprint []string
+
+	if inline := annotations[ProfilesAnnotation]; inline != "" {
+		raw := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(inline), &raw); err != nil {
+			return nil, "", fmt.Errorf("error parsing annotation %s: %w", ProfilesAnnotation, err)
+		}
+		for name, values := range raw {
+			if err := profiles.add(name, values); err != nil {
+				return nil, "", fmt.Errorf("error in annotation %s: %w", ProfilesAnnotation, err)
+			}
+		}
+		fingerprint = append(fingerprint, inline)
+	}
+
+	if reference := annotations[ProfilesConfigMapAnnotation]; reference != "" {
+		namespace, name := obj.GetNamespace(), reference
+		if parts := strings.SplitN(reference, "/", 2); len(parts) == 2 {
+			namespace, name = parts[0], parts[1]
+		}
+		// Anyone able to annotate a composition definition could otherwise read the ConfigMaps of any namespace
+		if namespace != obj.GetNamespace() && !slices.Contains(p.ProfilesNamespaces, namespace) {
+			return nil, "", fmt.Errorf("values profiles cannot be read from configmap %s/%s, outside of the namespace of the composition definition", namespace, name)
+		}
+
+		data, resourceVersion, err := kubeHelper.GetConfigMapData(ctx, name, namespace, p.DynClient)
+		if err != nil {
+			return nil, "", fmt.Errorf("error while retrieving values profiles: %w", err)
+		}
+		for key, content := range data {
+			values := map[string]interface{}{}
+			if err := yaml.Unmarshal([]byte(content), &values); err != nil {
+				return nil, "", fmt.Errorf("error parsing key %s of configmap %s/%s: %w", key, namespace, name, err)
+			}
+			profile := key
+			if ext := path.Ext(key); ext == ".yaml" || ext == ".yml" {
+				profile = strings.TrimSuffix(key, ext)
+			}
+			if _, ok := profiles[profile]; ok {
+				return nil, "", fmt.Errorf("values profile %s is defined more than once", profile)
+			}
+			if err := profiles.add(profile, values); err != nil {
+				return nil, "", fmt.Errorf("error in configmap %s/%s: %w", namespace, name, err)
+			}
+		}
+		fingerprint = append(fingerprint, fmt.Sprintf("%s/%s@%s", namespace, name, resourceVersion))
+	}
+
+	return profiles, strings.Join(fingerprint, "|"), nil
+}
+
+// add validates and adds a values profile
+func (p Profiles) add(name string, values interface{}) error {
+	if name == "" {
+		return fmt.Errorf("values profile name cannot be empty")
+	}
+	if values == nil {
+		p[name] = map[string]interface{}{}
+		return nil
+	}
+	overlay, ok := values.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("values of profile %s must be an object", name)
+	}
+	p[name] = overlay
+	return nil
+}
+
+// names returns the profile names in a stable order
+func (p Profiles) names() []string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,91 @@
+package processor
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	kubeHelper "finops-composition-definition-parser/internal/helpers/kube/client"
+)
+
+func TestLoadInlineProfiles(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	obj.SetAnnotations(map[string]string{
+		ProfilesAnnotation: `
+small:
+  vm:
+    sku: Standard_B1s
+large: {"vm": {"sku": "Standard_D4s_v5"}}
+empty:
+`,
+	})
+
+	p := &Processor{}
+	profiles, fingerprint, err := p.loadProfiles(context.Background(), obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint == "" {
+		t.Fatal("expected a fingerprint for the inline profiles")
+	}
+
+	names := profiles.names()
+	if len(names) != 3 || names[0] != "empty" || names[1] != "large" || names[2] != "small" {
+		t.Fatalf("unexpected profiles: %v", names)
+	}
+	vm, ok := profiles["large"]["vm"].(map[string]interface{})
+	if !ok || vm["sku"] != "Standard_D4s_v5" {
+		t.Fatalf("unexpected values for profile large: %v", profiles["large"])
+	}
+
+	obj.SetAnnotations(map[string]string{ProfilesAnnotation: `small: [not, an, object]`})
+	if _, _, err := p.loadProfiles(context.Background(), obj); err == nil {
+		t.Fatal("expected profiles that are not objects to be rejected")
+	}
+}
+
+func TestProfileAnnotationsChanged(t *testing.T) {
+	oldObj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	newObj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	oldObj.SetAnnotations(map[string]string{ProfilesConfigMapAnnotation: "profiles", "other": "a"})
+	newObj.SetAnnotations(map[string]string{ProfilesConfigMapAnnotation: "profiles", "other": "b"})
+	if ProfileAnnotationsChanged(oldObj, newObj) {
+		t.Fatal("unrelated annotations should not be reported as a change")
+	}
+
+	newObj.SetAnnotations(map[string]string{ProfilesConfigMapAnnotation: "other-profiles"})
+	if !ProfileAnnotationsChanged(oldObj, newObj) {
+		t.Fatal("expected the configmap reference change to be reported")
+	}
+}
+
+func TestLoadConfigMapProfilesNamespace(t *testing.T) {
+	configMap := testProfilesConfigMap("1")
+	configMap.SetNamespace("catalog")
+	dynClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		kubeHelper.ConfigMapResource: "ConfigMapList",
+	}, testProfilesConfigMap("1"), configMap)
+
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	obj.SetNamespace("krateo-system")
+	p := &Processor{DynClient: dynClient}
+	for _, reference := range []string{"profiles", "krateo-system/profiles"} {
+		obj.SetAnnotations(map[string]string{ProfilesConfigMapAnnotation: reference})
+		if profiles, _, err := p.loadProfiles(context.Background(), obj); err != nil || len(profiles) != 1 {
+			t.Fatalf("expected the profiles of %s, got %v and error %v", reference, profiles, err)
+		}
+	}
+
+	obj.SetAnnotations(map[string]string{ProfilesConfigMapAnnotation: "catalog/profiles"})
+	if _, _, err := p.loadProfiles(context.Background(), obj); err == nil {
+		t.Fatal("expected a configmap of another namespace to be rejected")
+	}
+	p.ProfilesNamespaces = []string{"catalog"}
+	if _, _, err := p.loadProfiles(context.Background(), obj); err != nil {
+		t.Fatalf("expected the configmap of an allowed namespace to be read: %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+
+	types "finops-composition-definition-parser/apis"
+	compositionsHelper "finops-composition-definition-parser/internal/helpers/kube/compositions"
+	"finops-composition-definition-parser/internal/processor"
+)
+
+// Operation is the processing requested for a composition definition
+type Operation string
+
+const (
+	OperationCreate Operation = "create"
+	OperationUpdate Operation = "update"
+	OperationDelete Operation = "delete"
+	// Operations on composition instances, keyed by the composition id
+	OperationCreateComposition Operation = "create-composition"
+	OperationDeleteComposition Operation = "delete-composition"
+)
+
+// Job describes the processing requested for a composition definition. Either the reference or the
+// object is needed for create and update operations. Composition jobs read the composition through the
+// reference, if given
+type Job struct {
+	Operation     Operation
+	CompositionId string
+	Reference     *types.Reference
+	Object        *unstructured.Unstructured
+
+	// creatingRequeues counts the times the composition was found still being created
+	creatingRequeues int
+}
+
+const (
+	// creatingDelay is the delay before processing again a composition that is still being created
+	creatingDelay = 10 * time.Second
+	// maxCreatingRequeues bounds how long a composition being created is waited for, 10 minutes
+	maxCreatingRequeues = 60
+)
+
+// Enqueuer receives the jobs to process, it is the Queue outside of the tests of the watcher and the resync
+type Enqueuer interface {
+	Add(job Job)
+}
+
+// Queue is a rate limited work queue of jobs keyed by composition definition id: jobs for the same
+// composition definition are coalesced, so that only the latest one is processed, and are never
+// processed concurrently. Failed jobs are retried with exponential backoff
+type Queue struct {
+	processor  *processor.Processor
+	queue      workqueue.TypedRateLimitingInterface[string]
+	maxRetries int
+	// handle processes a job, q.process unless replaced by the tests
+	handle func(ctx context.Context, job Job) error
+	// creatingDelay is the delay before processing again a composition still being created, at most
+	// maxCreatingRequeues times
+	creatingDelay       time.Duration
+	maxCreatingRequeues int
+
+	pending      map[string]Job
+	pendingMutex sync.Mutex
+}
+
+// New creates a queue that processes the jobs with the given processor, retrying each of them up to maxRetries times
+func New(p *processor.Processor, maxRetries int) *Queue {
+	return newQueue(p, maxRetries, defaultRateLimiter())
+}
+
+// defaultRateLimiter backs off each failing job exponentially, and bounds the overall retry rate
+func defaultRateLimiter() workqueue.TypedRateLimiter[string] {
+	return workqueue.NewTypedMaxOfRateLimiter(
+		workqueue.NewTypedItemExponentialFailureRateLimiter[string](time.Second, 5*time.Minute),
+		// 10 qps with bursts of 100 overall, so that many failing jobs do not hammer the registries and the sink
+		&workqueue.TypedBucketRateLimiter[string]{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+	)
+}
+
+func newQueue(p *processor.Processor, maxRetries int, rateLimiter workqueue.TypedRateLimiter[string]) *Queue {
+	q := &Queue{
+		processor: p,
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			rateLimiter,
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "composition-definitions"},
+		),
+		maxRetries:          maxRetries,
+		creatingDelay:       creatingDelay,
+		maxCreatingRequeues: maxCreatingRequeues,
+		pending:             map[string]Job{},
+	}
+	q.handle = q.process
+	return q
+}
+
+// Add enqueues a job, replacing the pending job for the same composition definition, if any
+func (q *Queue) Add(job Job) {
+	if job.CompositionId == "" {
+		log.Error().Msgf("discarding %s job without composition id", job.Operation)
+		return
+	}
+
+	q.pendingMutex.Lock()
+	if previous, ok := q.pending[job.CompositionId]; ok {
+		log.Debug().Msgf("coalescing %s job with pending %s job for composition definition %s", job.Operation, previous.Operation, job.CompositionId)
+	}
+	q.pending[job.CompositionId] = job
+	q.pendingMutex.Unlock()
+
+	q.queue.Add(job.CompositionId)
+}
+
+// Run starts the given number of workers and blocks until the context is cancelled
+func (q *Queue) Run(ctx context.Context, workers int) {
+	defer q.queue.ShutDown()
+
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, q.runWorker, time.Second)
+	}
+
+	<-ctx.Done()
+}
+
+func (q *Queue) runWorker(ctx context.Context) {
+	for q.processNextItem(ctx) {
+	}
+}
+
+func (q *Queue) processNextItem(ctx context.Context) bool {
+	compositionId, shutdown := q.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer q.queue.Done(compositionId)
+
+	job, ok := q.take(compositionId)
+	if !ok {
+		q.queue.Forget(compositionId)
+		return true
+	}
+
+	err := q.handle(ctx, job)
+	if err == nil {
+		q.queue.Forget(compositionId)
+		return true
+	}
+
+	// A composition still being created is not a failure, it is processed again later without using the retries,
+	// until the next event of the composition if it takes too long
+	if errors.Is(err, compositionsHelper.ErrCompositionCreating) {
+		if job.creatingRequeues >= q.maxCreatingRequeues {
+			log.Warn().Msgf("dropping %s job for composition %s still being created after %s, it is processed on its next event", job.Operation, compositionId, time.Duration(q.maxCreatingRequeues)*q.creatingDelay)
+			q.queue.Forget(compositionId)
+			return true
+		}
+		log.Debug().Msgf("composition %s is still being created, processing it again in %s", compositionId, q.creatingDelay)
+		job.creatingRequeues++
+		q.restore(job)
+		q.queue.AddAfter(compositionId, q.creatingDelay)
+		return true
+	}
+
+	if q.queue.NumRequeues(compositionId) < q.maxRetries {
+		log.Warn().Err(err).Msgf("error while processing %s job for composition definition %s, retrying", job.Operation, compositionId)
+		q.restore(job)
+		q.queue.AddRateLimited(compositionId)
+		return true
+	}
+
+	log.Error().Err(err).Msgf("dropping %s job for composition definition %s after %d retries", job.Operation, compositionId, q.maxRetries)
+	q.queue.Forget(compositionId)
+	return true
+}
+
+func (q *Queue) process(ctx context.Context, job Job) error {
+	switch job.Operation {
+	case OperationDelete:
+		return q.processor.Delete(ctx, job.CompositionId)
+	case OperationCreateComposition:
+		return q.processor.CreateComposition(ctx, job.Reference, job.CompositionId)
+	case OperationDeleteComposition:
+		return q.processor.DeleteComposition(ctx, job.CompositionId)
+	case OperationCreate:
+		if job.Object != nil {
+			return q.processor.CreateFromObject(ctx, job.Object, job.CompositionId)
+		}
+		return q.processor.Create(ctx, job.Reference, job.CompositionId)
+	case OperationUpdate:
+		if job.Object != nil {
+			return q.processor.UpdateFromObject(ctx, job.Object, job.CompositionId)
+		}
+		return q.processor.Update(ctx, job.Reference, job.CompositionId)
+	}
+	return fmt.Errorf("unknown operation %s", job.Operation)
+}
+
+// take removes and returns the pending job for the composition definition
+func (q *Queue) take(compositionId string) (Job, bool) {
+	q.pendingMutex.Lock()
+	defer q.pendingMutex.Unlock()
+	job, ok := q.pending[compositionId]
+	delete(q.pending, compositionId)
+	return job, ok
+}
+
+// restore puts back a failed job, unless a newer job for the same composition definition was added meanwhile
+func (q *Queue) restore(job Job) {
+	q.pendingMutex.Lock()
+	defer q.pendingMutex.Unlock()
+	if _, ok := q.pending[job.CompositionId]; !ok {
+		q.pending[job.CompositionId] = job
+	}
+}
@@ -0,0 +1,201 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+
+	compositionsHelper "finops-composition-definition-parser/internal/helpers/kube/compositions"
+)
+
+func TestQueueCompositionCreating(t *testing.T) {
+	const maxRetries = 1
+	q := New(nil, maxRetries)
+	q.creatingDelay = 10 * time.Millisecond
+
+	// The composition stays in Creating well past the retries of the queue before being created
+	var mutex sync.Mutex
+	calls := 0
+	done := make(chan struct{})
+	q.handle = func(ctx context.Context, job Job) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls++
+		if calls <= maxRetries+3 {
+			return fmt.Errorf("error while retrieving composition: %w", compositionsHelper.ErrCompositionCreating)
+		}
+		close(done)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx, 1)
+	q.Add(Job{Operation: OperationCreateComposition, CompositionId: "composition"})
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		mutex.Lock()
+		defer mutex.Unlock()
+		t.Fatalf("expected the composition to be processed once created, processed %d times", calls)
+	}
+	if requeues := q.queue.NumRequeues("composition"); requeues != 0 {
+		t.Fatalf("expected the composition being created not to use the retries, got %d", requeues)
+	}
+}
+
+func TestQueueCompositionCreatingCap(t *testing.T) {
+	q := New(nil, 1)
+	q.creatingDelay = time.Millisecond
+	q.maxCreatingRequeues = 3
+
+	// The composition never leaves Creating
+	var calls atomic.Int32
+	q.handle = func(ctx context.Context, job Job) error {
+		calls.Add(1)
+		return fmt.Errorf("error while retrieving composition: %w", compositionsHelper.ErrCompositionCreating)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx, 1)
+	q.Add(Job{Operation: OperationCreateComposition, CompositionId: "composition"})
+
+	// The job is dropped after the first call and the capped requeues
+	time.Sleep(200 * time.Millisecond)
+	if calls.Load() != 4 {
+		t.Fatalf("expected 4 calls before dropping the job, got %d", calls.Load())
+	}
+	if q.queue.Len() != 0 {
+		t.Fatalf("expected the job to be dropped, %d queued", q.queue.Len())
+	}
+}
+
+// testQueue returns a queue retrying right away, whose jobs are handled by handle
+func testQueue(maxRetries int, handle func(ctx context.Context, job Job) error) *Queue {
+	q := newQueue(nil, maxRetries, workqueue.NewTypedItemExponentialFailureRateLimiter[string](time.Millisecond, time.Millisecond))
+	q.handle = handle
+	return q
+}
+
+// processAll processes the queued jobs until the queue stays empty
+func processAll(t *testing.T, q *Queue) {
+	t.Helper()
+	ctx := context.Background()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if q.queue.Len() == 0 {
+			// The retries are added back after their delay
+			time.Sleep(20 * time.Millisecond)
+			if q.queue.Len() == 0 {
+				return
+			}
+		}
+		q.processNextItem(ctx)
+	}
+	t.Fatal("the queue was not drained")
+}
+
+func TestQueueRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   int
+		maxRetries int
+		calls      int
+		succeeded  bool
+	}{
+		{"success", 0, 3, 1, true},
+		{"retried", 2, 3, 3, true},
+		{"last retry", 3, 3, 4, true},
+		{"dropped", 10, 2, 3, false},
+		{"no retries", 1, 0, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, succeeded := 0, false
+			q := testQueue(tt.maxRetries, func(ctx context.Context, job Job) error {
+				calls++
+				if calls <= tt.failures {
+					return fmt.Errorf("failure %d", calls)
+				}
+				succeeded = true
+				return nil
+			})
+			q.Add(Job{Operation: OperationCreate, CompositionId: "uid"})
+			processAll(t, q)
+
+			if calls != tt.calls || succeeded != tt.succeeded {
+				t.Fatalf("expected %d calls and success %t, got %d calls and success %t", tt.calls, tt.succeeded, calls, succeeded)
+			}
+			// The failures are forgotten once the job succeeds or is dropped
+			if requeues := q.queue.NumRequeues("uid"); requeues != 0 {
+				t.Fatalf("expected the failures to be forgotten, got %d", requeues)
+			}
+		})
+	}
+}
+
+func TestQueueCoalescing(t *testing.T) {
+	var processed []Job
+	q := testQueue(3, func(ctx context.Context, job Job) error {
+		processed = append(processed, job)
+		return nil
+	})
+	q.Add(Job{Operation: OperationCreate, CompositionId: "uid"})
+	q.Add(Job{Operation: OperationUpdate, CompositionId: "uid"})
+	q.Add(Job{Operation: OperationDelete, CompositionId: "other"})
+	q.Add(Job{Operation: ""})
+	processAll(t, q)
+
+	// Only the latest job of each composition definition is processed
+	if len(processed) != 2 || processed[0].Operation != OperationUpdate || processed[0].CompositionId != "uid" ||
+		processed[1].Operation != OperationDelete || processed[1].CompositionId != "other" {
+		t.Fatalf("unexpected processed jobs: %+v", processed)
+	}
+}
+
+func TestQueueRestore(t *testing.T) {
+	var processed []Operation
+	var q *Queue
+	q = testQueue(3, func(ctx context.Context, job Job) error {
+		processed = append(processed, job.Operation)
+		if job.Operation == OperationCreate {
+			// A newer job arrives while the failing one is processed, it is not replaced by the retry
+			q.Add(Job{Operation: OperationDelete, CompositionId: job.CompositionId})
+			return fmt.Errorf("failure")
+		}
+		return nil
+	})
+	q.Add(Job{Operation: OperationCreate, CompositionId: "uid"})
+	processAll(t, q)
+
+	if len(processed) != 2 || processed[0] != OperationCreate || processed[1] != OperationDelete {
+		t.Fatalf("unexpected processed jobs: %v", processed)
+	}
+}
+
+func TestQueueRateLimiter(t *testing.T) {
+	rateLimiter := defaultRateLimiter()
+
+	// Each job backs off exponentially from one second
+	if delay := rateLimiter.When("uid"); delay != time.Second {
+		t.Fatalf("expected a first delay of 1s, got %s", delay)
+	}
+	if delay := rateLimiter.When("uid"); delay != 2*time.Second {
+		t.Fatalf("expected a second delay of 2s, got %s", delay)
+	}
+
+	// The first retries of many jobs are bounded by the bucket once its burst is used
+	var delay time.Duration
+	for i := 0; i < 200; i++ {
+		delay = rateLimiter.When(fmt.Sprintf("job-%d", i))
+	}
+	if delay <= time.Second {
+		t.Fatalf("expected the bucket to delay the retries beyond the burst, got %s", delay)
+	}
+}
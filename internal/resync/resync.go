@@ -0,0 +1,105 @@
+package resync
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+
+	kubeHelper "finops-composition-definition-parser/internal/helpers/kube/client"
+	"finops-composition-definition-parser/internal/processor"
+	"finops-composition-definition-parser/internal/queue"
+)
+
+// Resyncer rebuilds the annotation table from the CompositionDefinitions in the cluster
+type Resyncer struct {
+	DynClient dynamic.Interface
+	Processor *processor.Processor
+	Queue     queue.Enqueuer
+	// Interval between two resyncs, if zero the resync only runs at startup
+	Interval time.Duration
+}
+
+// Run resyncs at startup and then on every interval, until the context is cancelled
+func (r *Resyncer) Run(ctx context.Context) {
+	if err := r.Resync(ctx); err != nil {
+		log.Error().Err(err).Msg("error during startup resync")
+	}
+
+	if r.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Resync(ctx); err != nil {
+				log.Error().Err(err).Msg("error during periodic resync")
+			}
+		}
+	}
+}
+
+// Resync reprocesses the CompositionDefinitions whose chart or values profiles changed since they were stored and
+// deletes the composition ids stored in the table that no longer exist in the cluster
+func (r *Resyncer) Resync(ctx context.Context) error {
+	log.Info().Msg("resyncing composition definitions")
+
+	// The sink is listed before the cluster: a composition definition created and stored in between is then
+	// found in the cluster, instead of being stored but missing from the cluster and deleted
+	stored, err := r.Processor.List(ctx)
+	if err != nil {
+		return fmt.Errorf("error listing stored composition definitions: %w", err)
+	}
+
+	list, err := r.DynClient.Resource(kubeHelper.CompositionDefinitionResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing composition definitions: %w", err)
+	}
+
+	existing := map[string]bool{}
+	for i := range list.Items {
+		item := &list.Items[i]
+		compositionId := string(item.GetUID())
+		existing[compositionId] = true
+
+		fingerprint, err := r.Processor.Fingerprint(ctx, item)
+		if err != nil {
+			log.Error().Err(err).Msgf("error while computing fingerprint of composition definition %s", compositionId)
+			continue
+		}
+
+		if storedFingerprint := stored[compositionId]; storedFingerprint != "" && storedFingerprint == fingerprint {
+			log.Debug().Msgf("composition definition %s is up to date", compositionId)
+			continue
+		}
+
+		log.Info().Msgf("resync of composition definition %s %s", item.GetName(), item.GetNamespace())
+		r.Queue.Add(queue.Job{
+			Operation:     queue.OperationCreate,
+			CompositionId: compositionId,
+			Object:        item,
+		})
+	}
+
+	for compositionId := range stored {
+		if existing[compositionId] {
+			continue
+		}
+		log.Info().Msgf("composition definition %s no longer exists, deleting its annotations", compositionId)
+		r.Queue.Add(queue.Job{
+			Operation:     queue.OperationDelete,
+			CompositionId: compositionId,
+		})
+	}
+
+	log.Info().Msg("resync jobs enqueued")
+	return nil
+}
@@ -0,0 +1,129 @@
+package resync
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	types "finops-composition-definition-parser/apis"
+	kubeHelper "finops-composition-definition-parser/internal/helpers/kube/client"
+	"finops-composition-definition-parser/internal/processor"
+	"finops-composition-definition-parser/internal/queue"
+	"finops-composition-definition-parser/internal/sink"
+)
+
+// jobs records the jobs enqueued by the resync
+type jobs []queue.Job
+
+func (j *jobs) Add(job queue.Job) {
+	*j = append(*j, job)
+}
+
+func (j jobs) operation(compositionId string) queue.Operation {
+	for _, job := range j {
+		if job.CompositionId == compositionId {
+			return job.Operation
+		}
+	}
+	return ""
+}
+
+func testCompositionDefinition(uid, version string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "core.krateo.io/v1alpha1",
+		"kind":       "CompositionDefinition",
+		"metadata":   map[string]interface{}{"name": uid, "namespace": "krateo-system", "uid": uid},
+		"spec": map[string]interface{}{
+			"chart": map[string]interface{}{"url": "oci://registry/charts/" + uid, "version": version},
+		},
+	}}
+}
+
+// testResyncer returns a resyncer listing the composition definitions from a fake cluster, with the records
+// stored in a file sink
+func testResyncer(t *testing.T, stored map[string]string, objects ...runtime.Object) (*Resyncer, *dynamicfake.FakeDynamicClient, *jobs) {
+	t.Helper()
+	s, err := sink.NewFile(t.TempDir(), sink.FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for compositionId, fingerprint := range stored {
+		if err := s.Upsert(context.Background(), "annotations", sink.Record{CompositionId: compositionId, Fingerprint: fingerprint}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dynClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		kubeHelper.CompositionDefinitionResource: "CompositionDefinitionList",
+	}, objects...)
+	enqueued := &jobs{}
+	return &Resyncer{
+		DynClient: dynClient,
+		Processor: &processor.Processor{
+			DynClient: dynClient,
+			Sink:      s,
+			Mappings:  []types.AnnotationMapping{{Label: "pricing", Table: "annotations"}},
+		},
+		Queue: enqueued,
+	}, dynClient, enqueued
+}
+
+func TestResync(t *testing.T) {
+	unchanged := testCompositionDefinition("unchanged", "1.0.0")
+	changed := testCompositionDefinition("changed", "2.0.0")
+	added := testCompositionDefinition("added", "1.0.0")
+
+	p := &processor.Processor{}
+	fingerprint, err := p.Fingerprint(context.Background(), unchanged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, err := p.Fingerprint(context.Background(), testCompositionDefinition("changed", "1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _, enqueued := testResyncer(t, map[string]string{
+		"unchanged": fingerprint,
+		"changed":   previous,
+		"removed":   fingerprint,
+	}, unchanged, changed, added)
+	if err := r.Resync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*enqueued) != 3 {
+		t.Fatalf("expected 3 jobs, got %v", *enqueued)
+	}
+	for compositionId, operation := range map[string]queue.Operation{
+		"unchanged": "",
+		"changed":   queue.OperationCreate,
+		"added":     queue.OperationCreate,
+		"removed":   queue.OperationDelete,
+	} {
+		if got := enqueued.operation(compositionId); got != operation {
+			t.Fatalf("expected operation %q for %s, got %q", operation, compositionId, got)
+		}
+	}
+}
+
+func TestResyncListError(t *testing.T) {
+	r, dynClient, enqueued := testResyncer(t, map[string]string{"stored": "fingerprint"})
+	dynClient.PrependReactor("list", "compositiondefinitions", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("list failed")
+	})
+
+	// A failed list must not be mistaken for an empty cluster, deleting every stored record
+	if err := r.Resync(context.Background()); err == nil {
+		t.Fatal("expected an error when the composition definitions cannot be listed")
+	}
+	if len(*enqueued) != 0 {
+		t.Fatalf("expected no jobs, got %v", *enqueued)
+	}
+}
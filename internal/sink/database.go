@@ -0,0 +1,231 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+
+	chartHelper "finops-composition-definition-parser/internal/helpers/chart"
+)
+
+const (
+	// TypeCrate stores the records directly in CrateDB, over the PostgreSQL wire protocol
+	TypeCrate = "cratedb"
+	// TypePostgres stores the records in PostgreSQL, with jsonb columns instead of the CrateDB objects
+	TypePostgres = "postgres"
+)
+
+// createTableStatements create the table of the records if missing, with the columns used by the notebook
+var createTableStatements = map[string]string{
+	TypeCrate:    "CREATE TABLE IF NOT EXISTS %s (composition_id TEXT, keys OBJECT, provenance OBJECT, profiles OBJECT, chart_version TEXT, fingerprint TEXT, PRIMARY KEY (composition_id)) WITH (column_policy = 'dynamic')",
+	TypePostgres: "CREATE TABLE IF NOT EXISTS %s (composition_id TEXT, keys JSONB, provenance JSONB, profiles JSONB, chart_version TEXT, fingerprint TEXT, PRIMARY KEY (composition_id))",
+}
+
+// fingerprintColumnQuery tells whether the table has the fingerprint column, missing in the tables created by
+// the previous versions of the notebook. The schema is the current one unless the table is qualified
+const fingerprintColumnQuery = "SELECT count(*) FROM information_schema.columns WHERE table_schema = COALESCE(NULLIF($1, ''), current_schema()) AND table_name = $2 AND column_name = 'fingerprint'"
+
+// Database stores the records with parameterized statements over the PostgreSQL wire protocol. Tables are
+// created on first use
+type Database struct {
+	// Dialect is either TypeCrate or TypePostgres
+	Dialect string
+	pool    *pgxpool.Pool
+
+	created      map[string]bool
+	createdMutex sync.Mutex
+}
+
+// NewDatabase creates a database sink connecting to the given URL, e.g. postgres://crate:5432/doc. The
+// credentials, if given, replace the ones of the URL each time a connection is opened
+func NewDatabase(dialect, url string, credentials CredentialsFunc) (*Database, error) {
+	if _, ok := createTableStatements[dialect]; !ok {
+		return nil, fmt.Errorf("unknown database dialect %q", dialect)
+	}
+
+	config, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing database URL: %w", err)
+	}
+	if credentials != nil {
+		config.BeforeConnect = func(ctx context.Context, connConfig *pgx.ConnConfig) error {
+			username, password, err := credentials(ctx)
+			if err != nil {
+				return fmt.Errorf("error while retrieving database username and password: %w", err)
+			}
+			connConfig.User = username
+			connConfig.Password = password
+			return nil
+		}
+	}
+	config.ConnConfig.DefaultQueryExecMode = queryExecMode(dialect)
+
+	// Connections are opened on first use
+	pool, err := pgxpool.NewWithConfig(context.Background(), config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating database pool: %w", err)
+	}
+	return &Database{Dialect: dialect, pool: pool, created: map[string]bool{}}, nil
+}
+
+// queryExecMode returns how the statements are sent. pgx cannot encode the parameters CrateDB describes for its
+// OBJECT columns, so CrateDB uses the simple protocol, with the arguments quoted by pgx on the client side
+func queryExecMode(dialect string) pgx.QueryExecMode {
+	if dialect == TypeCrate {
+		return pgx.QueryExecModeSimpleProtocol
+	}
+	return pgx.QueryExecModeCacheStatement
+}
+
+// Close closes the connections to the database
+func (d *Database) Close() {
+	d.pool.Close()
+}
+
+// Upsert inserts the record, or updates the row of its composition id
+func (d *Database) Upsert(ctx context.Context, table string, record Record) error {
+	if err := d.createTable(ctx, table); err != nil {
+		return err
+	}
+
+	arguments, err := upsertArguments(record)
+	if err != nil {
+		return err
+	}
+	if _, err := d.pool.Exec(ctx, upsertStatement(table), arguments...); err != nil {
+		return fmt.Errorf("error upserting into %s: %w", table, err)
+	}
+	return nil
+}
+
+// upsertStatement returns the statement upserting a record in the table, with the arguments of upsertArguments
+func upsertStatement(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (composition_id, keys, provenance, profiles, chart_version, fingerprint) VALUES ($1, $2, $3, $4, $5, $6) "+
+		"ON CONFLICT (composition_id) DO UPDATE SET keys = excluded.keys, provenance = excluded.provenance, profiles = excluded.profiles, chart_version = excluded.chart_version, fingerprint = excluded.fingerprint",
+		sanitizeTable(table))
+}
+
+// upsertArguments returns the arguments of the upsert statement, with the keys, provenance and profiles encoded
+// as JSON text, empty objects if not set
+func upsertArguments(record Record) ([]any, error) {
+	if record.Keys == nil {
+		record.Keys = map[string]float64{}
+	}
+	if record.Provenance == nil {
+		record.Provenance = map[string][]chartHelper.Provenance{}
+	}
+	if record.Profiles == nil {
+		record.Profiles = map[string]map[string]float64{}
+	}
+	keys, err := json.Marshal(record.Keys)
+	if err != nil {
+		return nil, fmt.Errorf("error while converting resources to json: %w", err)
+	}
+	provenance, err := json.Marshal(record.Provenance)
+	if err != nil {
+		return nil, fmt.Errorf("error while converting provenance to json: %w", err)
+	}
+	profiles, err := json.Marshal(record.Profiles)
+	if err != nil {
+		return nil, fmt.Errorf("error while converting profiles to json: %w", err)
+	}
+	return []any{record.CompositionId, string(keys), string(provenance), string(profiles), record.ChartVersion, record.Fingerprint}, nil
+}
+
+// Delete removes the row of the composition id
+func (d *Database) Delete(ctx context.Context, table string, compositionId string) error {
+	if err := d.createTable(ctx, table); err != nil {
+		return err
+	}
+
+	if _, err := d.pool.Exec(ctx, deleteStatement(table), compositionId); err != nil {
+		return fmt.Errorf("error deleting from %s: %w", table, err)
+	}
+	return nil
+}
+
+// List returns the composition ids of the rows of the table, with their fingerprint
+func (d *Database) List(ctx context.Context, table string) (map[string]string, error) {
+	if err := d.createTable(ctx, table); err != nil {
+		return nil, err
+	}
+
+	// CrateDB makes the writes visible to the searches only after a refresh
+	if d.Dialect == TypeCrate {
+		if _, err := d.pool.Exec(ctx, fmt.Sprintf("REFRESH TABLE %s", sanitizeTable(table))); err != nil {
+			return nil, fmt.Errorf("error refreshing %s: %w", table, err)
+		}
+	}
+
+	rows, err := d.pool.Query(ctx, listStatement(table))
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %w", table, err)
+	}
+	fingerprints := map[string]string{}
+	var compositionId, fingerprint string
+	_, err = pgx.ForEachRow(rows, []any{&compositionId, &fingerprint}, func() error {
+		fingerprints[compositionId] = fingerprint
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %w", table, err)
+	}
+	return fingerprints, nil
+}
+
+// deleteStatement returns the statement deleting the row of the composition id given as argument
+func deleteStatement(table string) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE composition_id = $1", sanitizeTable(table))
+}
+
+// listStatement returns the statement listing the composition ids and fingerprints of the table
+func listStatement(table string) string {
+	return fmt.Sprintf("SELECT composition_id, COALESCE(fingerprint, '') FROM %s", sanitizeTable(table))
+}
+
+// createTable creates the table if it was not created yet by this sink
+func (d *Database) createTable(ctx context.Context, table string) error {
+	d.createdMutex.Lock()
+	defer d.createdMutex.Unlock()
+	if d.created[table] {
+		return nil
+	}
+
+	if _, err := d.pool.Exec(ctx, fmt.Sprintf(createTableStatements[d.Dialect], sanitizeTable(table))); err != nil {
+		return fmt.Errorf("error creating table %s: %w", table, err)
+	}
+
+	// The tables created by the previous versions have no fingerprint column
+	schema, name := splitTable(table)
+	var columns int
+	if err := d.pool.QueryRow(ctx, fingerprintColumnQuery, schema, name).Scan(&columns); err != nil {
+		return fmt.Errorf("error reading the columns of table %s: %w", table, err)
+	}
+	if columns == 0 {
+		if _, err := d.pool.Exec(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN fingerprint TEXT", sanitizeTable(table))); err != nil {
+			return fmt.Errorf("error adding the fingerprint column to table %s: %w", table, err)
+		}
+	}
+	log.Debug().Msgf("table %s ready", table)
+	d.created[table] = true
+	return nil
+}
+
+// splitTable returns the schema, empty if not qualified, and the name of the table
+func splitTable(table string) (string, string) {
+	if schema, name, ok := strings.Cut(table, "."); ok {
+		return schema, name
+	}
+	return "", table
+}
+
+// sanitizeTable quotes a table name, optionally qualified by its schema as "schema.table"
+func sanitizeTable(table string) string {
+	return pgx.Identifier(strings.Split(table, ".")).Sanitize()
+}
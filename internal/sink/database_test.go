@@ -0,0 +1,229 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	chartHelper "finops-composition-definition-parser/internal/helpers/chart"
+)
+
+// TestDatabaseSink runs against the database at SINK_TEST_DATABASE_URL, e.g. a local container started with
+// docker run -p 5432:5432 crate, and SINK_TEST_DATABASE_TYPE set to cratedb (default) or postgres
+func TestDatabaseSink(t *testing.T) {
+	url := os.Getenv("SINK_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("SINK_TEST_DATABASE_URL not set")
+	}
+	dialect := os.Getenv("SINK_TEST_DATABASE_TYPE")
+	if dialect == "" {
+		dialect = TypeCrate
+	}
+
+	s, err := NewDatabase(dialect, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	table := fmt.Sprintf("sink_test_%d", time.Now().UnixNano())
+	defer s.pool.Exec(ctx, "DROP TABLE IF EXISTS "+sanitizeTable(table))
+
+	record := Record{
+		CompositionId: "uid'; DROP TABLE users; --",
+		Keys:          map[string]float64{"Standard_B1s": 2},
+		Provenance:    map[string][]chartHelper.Provenance{"Standard_B1s": {{Template: "vm/templates/vm.yaml", Source: chartHelper.SourceTemplate}}},
+		ChartVersion:  "1.0.0",
+		Fingerprint:   "chart|profiles",
+	}
+	if err := s.Upsert(ctx, table, record); err != nil {
+		t.Fatal(err)
+	}
+	record.Keys["Standard_B1s"] = 3
+	record.ChartVersion = "1.1.0"
+	if err := s.Upsert(ctx, table, record); err != nil {
+		t.Fatal(err)
+	}
+
+	var chartVersion string
+	if err := s.pool.QueryRow(ctx, "SELECT chart_version FROM "+sanitizeTable(table)+" WHERE composition_id = $1", record.CompositionId).Scan(&chartVersion); err != nil {
+		t.Fatal(err)
+	}
+	if chartVersion != "1.1.0" {
+		t.Fatalf("expected the upsert to update the row, got chart version %s", chartVersion)
+	}
+
+	fingerprints, err := s.List(ctx, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fingerprints) != 1 || fingerprints[record.CompositionId] != record.Fingerprint {
+		t.Fatalf("unexpected composition ids: %v", fingerprints)
+	}
+
+	if err := s.Delete(ctx, table, record.CompositionId); err != nil {
+		t.Fatal(err)
+	}
+	fingerprints, err = s.List(ctx, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fingerprints) != 0 {
+		t.Fatalf("expected no composition ids after the delete, got %v", fingerprints)
+	}
+}
+
+func TestDatabaseStatements(t *testing.T) {
+	for table, quoted := range map[string]string{
+		"annotations":                    `"annotations"`,
+		"doc.annotations":                `"doc"."annotations"`,
+		`annotations"; DROP TABLE users`: `"annotations""; DROP TABLE users"`,
+	} {
+		for _, statement := range []string{upsertStatement(table), deleteStatement(table), listStatement(table), fmt.Sprintf(createTableStatements[TypeCrate], sanitizeTable(table))} {
+			if !strings.Contains(statement, " "+quoted) {
+				t.Fatalf("expected the table %s to be quoted as %s in %s", table, quoted, statement)
+			}
+		}
+	}
+
+	// The values are always bound to placeholders
+	if statement := upsertStatement("annotations"); !strings.Contains(statement, "VALUES ($1, $2, $3, $4, $5, $6)") {
+		t.Fatalf("unexpected upsert statement: %s", statement)
+	}
+	if statement := deleteStatement("annotations"); !strings.HasSuffix(statement, "WHERE composition_id = $1") {
+		t.Fatalf("unexpected delete statement: %s", statement)
+	}
+
+	if schema, name := splitTable("doc.annotations"); schema != "doc" || name != "annotations" {
+		t.Fatalf("unexpected split of a qualified table: %s %s", schema, name)
+	}
+	if schema, name := splitTable("annotations"); schema != "" || name != "annotations" {
+		t.Fatalf("unexpected split of a table: %s %s", schema, name)
+	}
+}
+
+func TestDatabaseArguments(t *testing.T) {
+	arguments, err := upsertArguments(Record{
+		CompositionId: "uid'; DROP TABLE users; --",
+		Keys:          map[string]float64{"Standard_B1s": 2},
+		Provenance:    map[string][]chartHelper.Provenance{"Standard_B1s": {{Template: "vm/templates/vm.yaml", Source: chartHelper.SourceTemplate}}},
+		ChartVersion:  "1.0.0",
+		Fingerprint:   "chart|profiles",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(arguments) != 6 || arguments[0] != "uid'; DROP TABLE users; --" || arguments[1] != `{"Standard_B1s":2}` || arguments[3] != "{}" ||
+		arguments[4] != "1.0.0" || arguments[5] != "chart|profiles" {
+		t.Fatalf("unexpected upsert arguments: %v", arguments)
+	}
+	if provenance, ok := arguments[2].(string); !ok || !strings.Contains(provenance, `"template":"vm/templates/vm.yaml"`) {
+		t.Fatalf("unexpected provenance argument: %v", arguments[2])
+	}
+
+	// The columns are never null
+	arguments, err = upsertArguments(Record{CompositionId: "uid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arguments[1] != "{}" || arguments[2] != "{}" || arguments[3] != "{}" {
+		t.Fatalf("expected empty objects, got %v", arguments)
+	}
+}
+
+func TestDatabaseQueryExecMode(t *testing.T) {
+	// The pool connects on first use, no database is needed
+	for dialect, mode := range map[string]pgx.QueryExecMode{
+		TypePostgres: pgx.QueryExecModeCacheStatement,
+		TypeCrate:    pgx.QueryExecModeSimpleProtocol,
+	} {
+		s, err := NewDatabase(dialect, "postgres://user@localhost:5432/doc", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.pool.Config().ConnConfig.DefaultQueryExecMode; got != mode {
+			t.Fatalf("expected the %s query exec mode for %s, got %s", mode, dialect, got)
+		}
+		s.Close()
+	}
+	if _, err := NewDatabase("mysql", "postgres://user@localhost:5432/doc", nil); err == nil {
+		t.Fatal("expected an error for an unknown dialect")
+	}
+}
+
+// TestDatabaseSinkQuoting round-trips values that would break a statement if the arguments were not quoted, which
+// matters on CrateDB where pgx interpolates them on the client side
+func TestDatabaseSinkQuoting(t *testing.T) {
+	url := os.Getenv("SINK_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("SINK_TEST_DATABASE_URL not set")
+	}
+	dialect := os.Getenv("SINK_TEST_DATABASE_TYPE")
+	if dialect == "" {
+		dialect = TypeCrate
+	}
+
+	s, err := NewDatabase(dialect, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// pgx only interpolates the arguments when backslashes are not escapes
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := conn.Conn().PgConn().ParameterStatus("standard_conforming_strings"); status != "on" {
+		t.Fatalf("expected standard_conforming_strings to be on, got %q", status)
+	}
+	conn.Release()
+
+	table := fmt.Sprintf("sink_test_%d", time.Now().UnixNano())
+	defer s.pool.Exec(ctx, "DROP TABLE IF EXISTS "+sanitizeTable(table))
+
+	const value = `it's \' \\ $1 '); --`
+	record := Record{
+		CompositionId: value,
+		Keys:          map[string]float64{value: 2},
+		ChartVersion:  value,
+		Fingerprint:   value,
+	}
+	if err := s.Upsert(ctx, table, record); err != nil {
+		t.Fatal(err)
+	}
+	fingerprints, err := s.List(ctx, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fingerprints) != 1 || fingerprints[value] != value {
+		t.Fatalf("unexpected composition ids: %v", fingerprints)
+	}
+
+	var chartVersion string
+	var keys map[string]any
+	if err := s.pool.QueryRow(ctx, "SELECT chart_version, keys FROM "+sanitizeTable(table)+" WHERE composition_id = $1", value).Scan(&chartVersion, &keys); err != nil {
+		t.Fatal(err)
+	}
+	if chartVersion != value || len(keys) != 1 || keys[value] != float64(2) {
+		t.Fatalf("unexpected row: %q %v", chartVersion, keys)
+	}
+
+	if err := s.Delete(ctx, table, value); err != nil {
+		t.Fatal(err)
+	}
+	if fingerprints, err := s.List(ctx, table); err != nil || len(fingerprints) != 0 {
+		t.Fatalf("expected no composition ids after the delete, got %v: %v", fingerprints, err)
+	}
+}
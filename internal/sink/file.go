@@ -0,0 +1,260 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TypeFile writes the records in a directory, for offline and debugging use
+	TypeFile = "file"
+	// TypeStdout writes each operation as a JSON line on the standard output
+	TypeStdout = "stdout"
+
+	// FormatJSON writes a file for each record, in a directory for each table
+	FormatJSON = "json"
+	// FormatNDJSON appends each operation as a JSON line to a file for each table
+	FormatNDJSON = "ndjson"
+)
+
+// temporaryPrefix names the record files being written
+const temporaryPrefix = ".record-"
+
+// Operation is a line of the NDJSON outputs
+type Operation struct {
+	Time          time.Time `json:"time"`
+	Operation     string    `json:"operation"`
+	Table         string    `json:"table"`
+	CompositionId string    `json:"composition_id"`
+	// Record is set for the upserts only
+	Record *Record `json:"record,omitempty"`
+}
+
+// File stores the records in a directory. With FormatJSON each record is the file <table>/<composition id>.json,
+// replaced at each upsert; with FormatNDJSON the operations are appended to <table>.ndjson, and the stored
+// composition ids are the ones upserted and not deleted since
+type File struct {
+	Directory string
+	Format    string
+
+	mutex sync.Mutex
+}
+
+// NewFile creates a file sink writing in the directory, created if missing
+func NewFile(directory, format string) (*File, error) {
+	if format == "" {
+		format = FormatJSON
+	}
+	if format != FormatJSON && format != FormatNDJSON {
+		return nil, fmt.Errorf("unknown file sink format %q", format)
+	}
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("error creating sink directory: %w", err)
+	}
+	return &File{Directory: directory, Format: format}, nil
+}
+
+// Upsert writes the record
+func (f *File) Upsert(ctx context.Context, table string, record Record) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.Format == FormatNDJSON {
+		return f.append(table, Operation{Operation: "upsert", CompositionId: record.CompositionId, Record: &record})
+	}
+
+	content, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error while converting record to json: %w", err)
+	}
+
+	tableDirectory := filepath.Join(f.Directory, url.PathEscape(table))
+	if err := os.MkdirAll(tableDirectory, 0755); err != nil {
+		return fmt.Errorf("error creating table directory: %w", err)
+	}
+
+	// Write to a temporary file first, so that readers never see a partial record
+	tmp, err := os.CreateTemp(tableDirectory, temporaryPrefix)
+	if err != nil {
+		return fmt.Errorf("error creating record file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(content, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing record file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing record file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(tableDirectory, recordFileName(record.CompositionId))); err != nil {
+		return fmt.Errorf("error writing record file: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the record
+func (f *File) Delete(ctx context.Context, table string, compositionId string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.Format == FormatNDJSON {
+		return f.append(table, Operation{Operation: "delete", CompositionId: compositionId})
+	}
+
+	err := os.Remove(filepath.Join(f.Directory, url.PathEscape(table), recordFileName(compositionId)))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error deleting record file: %w", err)
+	}
+	return nil
+}
+
+// List returns the composition ids of the records of the table, with their fingerprint
+func (f *File) List(ctx context.Context, table string) (map[string]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.Format == FormatNDJSON {
+		return f.replay(table)
+	}
+
+	tableDirectory := filepath.Join(f.Directory, url.PathEscape(table))
+	entries, err := os.ReadDir(tableDirectory)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading table directory: %w", err)
+	}
+
+	fingerprints := map[string]string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, temporaryPrefix) || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(tableDirectory, name))
+		if err != nil {
+			return nil, fmt.Errorf("error reading record file: %w", err)
+		}
+		record := Record{}
+		if err := json.Unmarshal(content, &record); err != nil {
+			return nil, fmt.Errorf("error parsing record file %s: %w", name, err)
+		}
+		fingerprints[record.CompositionId] = record.Fingerprint
+	}
+	return fingerprints, nil
+}
+
+// append writes the operation as a line of the NDJSON file of the table
+func (f *File) append(table string, operation Operation) error {
+	operation.Time = time.Now().UTC()
+	operation.Table = table
+	line, err := json.Marshal(operation)
+	if err != nil {
+		return fmt.Errorf("error while converting operation to json: %w", err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(f.Directory, url.PathEscape(table)+".ndjson"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening table file: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing table file: %w", err)
+	}
+	return file.Close()
+}
+
+// replay reads the operations of the NDJSON file of the table and returns the composition ids still stored,
+// with the fingerprint of their last upsert
+func (f *File) replay(table string) (map[string]string, error) {
+	file, err := os.Open(filepath.Join(f.Directory, url.PathEscape(table)+".ndjson"))
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening table file: %w", err)
+	}
+	defer file.Close()
+
+	fingerprints := map[string]string{}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			operation := Operation{}
+			if err := json.Unmarshal(line, &operation); err != nil {
+				return nil, fmt.Errorf("error parsing table file: %w", err)
+			}
+			switch operation.Operation {
+			case "upsert":
+				fingerprints[operation.CompositionId] = ""
+				if operation.Record != nil {
+					fingerprints[operation.CompositionId] = operation.Record.Fingerprint
+				}
+			case "delete":
+				delete(fingerprints, operation.CompositionId)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading table file: %w", err)
+		}
+	}
+	return fingerprints, nil
+}
+
+// recordFileName escapes the composition id, so that it cannot escape the table directory
+func recordFileName(compositionId string) string {
+	return url.PathEscape(compositionId) + ".json"
+}
+
+// Stream writes each operation as a JSON line, e.g. on the standard output. Nothing is stored, so List
+// returns no composition ids
+type Stream struct {
+	Writer io.Writer
+
+	mutex sync.Mutex
+}
+
+// Upsert writes an upsert line with the record
+func (s *Stream) Upsert(ctx context.Context, table string, record Record) error {
+	return s.write(Operation{Operation: "upsert", Table: table, CompositionId: record.CompositionId, Record: &record})
+}
+
+// Delete writes a delete line
+func (s *Stream) Delete(ctx context.Context, table string, compositionId string) error {
+	return s.write(Operation{Operation: "delete", Table: table, CompositionId: compositionId})
+}
+
+// List returns no composition ids
+func (s *Stream) List(ctx context.Context, table string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (s *Stream) write(operation Operation) error {
+	operation.Time = time.Now().UTC()
+	line, err := json.Marshal(operation)
+	if err != nil {
+		return fmt.Errorf("error while converting operation to json: %w", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.Writer.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing operation: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSink(t *testing.T) {
+	for _, format := range []string{FormatJSON, FormatNDJSON} {
+		t.Run(format, func(t *testing.T) {
+			directory := t.TempDir()
+			s, err := NewFile(directory, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.Background()
+			for _, compositionId := range []string{"b", "../a"} {
+				record := Record{CompositionId: compositionId, Keys: map[string]float64{"Standard_B1s": 1}, ChartVersion: "1.0.0", Fingerprint: "fingerprint-" + compositionId}
+				if err := s.Upsert(ctx, "annotations", record); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Delete(ctx, "annotations", "b"); err != nil {
+				t.Fatal(err)
+			}
+
+			fingerprints, err := s.List(ctx, "annotations")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fingerprints) != 1 || fingerprints["../a"] != "fingerprint-../a" {
+				t.Fatalf("unexpected composition ids: %v", fingerprints)
+			}
+			if _, err := os.Stat(filepath.Join(directory, "a.json")); !os.IsNotExist(err) {
+				t.Fatal("record written outside of the table directory")
+			}
+
+			if format == FormatJSON {
+				content, err := os.ReadFile(filepath.Join(directory, "annotations", "..%2Fa.json"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				record := Record{}
+				if err := json.Unmarshal(content, &record); err != nil {
+					t.Fatal(err)
+				}
+				if record.CompositionId != "../a" || record.Keys["Standard_B1s"] != 1 || record.ChartVersion != "1.0.0" {
+					t.Fatalf("unexpected record: %+v", record)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamSink(t *testing.T) {
+	buf := &bytes.Buffer{}
+	s := &Stream{Writer: buf}
+
+	ctx := context.Background()
+	if err := s.Upsert(ctx, "annotations", Record{CompositionId: "uid", Keys: map[string]float64{"Standard_B1s": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "annotations", "uid"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", buf.String())
+	}
+	upsert := Operation{}
+	if err := json.Unmarshal([]byte(lines[0]), &upsert); err != nil {
+		t.Fatal(err)
+	}
+	if upsert.Operation != "upsert" || upsert.Table != "annotations" || upsert.Record == nil || upsert.Record.Keys["Standard_B1s"] != 1 {
+		t.Fatalf("unexpected upsert line: %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"operation":"delete"`) {
+		t.Fatalf("unexpected delete line: %s", lines[1])
+	}
+}
@@ -0,0 +1,111 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	chartHelper "finops-composition-definition-parser/internal/helpers/chart"
+	notebookHelper "finops-composition-definition-parser/internal/helpers/notebook"
+)
+
+// Notebook stores the records through the finops-database-handler notebook, authenticated with the
+// database credentials
+type Notebook struct {
+	Client      *notebookHelper.Client
+	Credentials CredentialsFunc
+}
+
+// Upsert calls the notebook with the 'create' operation, which upserts the row of the composition id
+func (n *Notebook) Upsert(ctx context.Context, table string, record Record) error {
+	username, password, err := n.credentials(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The notebook expects JSON objects, never null
+	if record.Keys == nil {
+		record.Keys = map[string]float64{}
+	}
+	if record.Provenance == nil {
+		record.Provenance = map[string][]chartHelper.Provenance{}
+	}
+	if record.Profiles == nil {
+		record.Profiles = map[string]map[string]float64{}
+	}
+
+	keys, err := json.Marshal(record.Keys)
+	if err != nil {
+		return fmt.Errorf("error while converting resources to json: %w", err)
+	}
+	provenance, err := json.Marshal(record.Provenance)
+	if err != nil {
+		return fmt.Errorf("error while converting provenance to json: %w", err)
+	}
+	profiles, err := json.Marshal(record.Profiles)
+	if err != nil {
+		return fmt.Errorf("error while converting profiles to json: %w", err)
+	}
+
+	err = n.Client.CallNotebook(ctx, notebookHelper.Request{
+		Operation:     "create",
+		CompositionId: record.CompositionId,
+		Keys:          keys,
+		Provenance:    provenance,
+		Profiles:      profiles,
+		ChartVersion:  record.ChartVersion,
+		Fingerprint:   record.Fingerprint,
+		Table:         table,
+		Username:      username,
+		Password:      password,
+	})
+	if err != nil {
+		return fmt.Errorf("error while calling notebook: %w", err)
+	}
+	return nil
+}
+
+// Delete calls the notebook with the 'delete' operation
+func (n *Notebook) Delete(ctx context.Context, table string, compositionId string) error {
+	username, password, err := n.credentials(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = n.Client.CallNotebook(ctx, notebookHelper.Request{
+		Operation:     "delete",
+		CompositionId: compositionId,
+		Table:         table,
+		Username:      username,
+		Password:      password,
+	})
+	if err != nil {
+		return fmt.Errorf("error while calling notebook: %w", err)
+	}
+	return nil
+}
+
+// List calls the notebook with the 'list' operation
+func (n *Notebook) List(ctx context.Context, table string) (map[string]string, error) {
+	username, password, err := n.credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprints, err := n.Client.ListNotebook(ctx, table, username, password)
+	if err != nil {
+		return nil, fmt.Errorf("error while calling notebook: %w", err)
+	}
+	return fingerprints, nil
+}
+
+func (n *Notebook) credentials(ctx context.Context) (string, string, error) {
+	if n.Credentials == nil {
+		return "", "", nil
+	}
+	username, password, err := n.Credentials(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("error while retrieving database username and password: %w", err)
+	}
+	return username, password, nil
+}
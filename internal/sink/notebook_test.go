@@ -0,0 +1,65 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNotebookSink(t *testing.T) {
+	var parameters map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "pass" {
+			t.Errorf("unexpected credentials %s %s", username, password)
+		}
+		parameters = map[string]string{}
+		if err := json.NewDecoder(r.Body).Decode(&parameters); err != nil {
+			t.Error(err)
+		}
+		if parameters["operation"] == "list" {
+			w.Write([]byte(`"[{\"composition_id\": \"a\", \"fingerprint\": \"fa\"}, {\"composition_id\": \"b\", \"fingerprint\": null}]\n"`))
+		}
+	}))
+	defer server.Close()
+
+	s, err := New(Config{
+		NotebookUrl: server.URL,
+		Credentials: func(ctx context.Context) (string, string, error) { return "user", "pass", nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	record := Record{CompositionId: "uid", Keys: map[string]float64{"Standard_B1s": 2}, Fingerprint: "chart|profiles"}
+	if err := s.Upsert(ctx, "annotations", record); err != nil {
+		t.Fatal(err)
+	}
+	if parameters["operation"] != "create" || parameters["composition_id"] != "uid" || parameters["annotation_table"] != "annotations" {
+		t.Fatalf("unexpected parameters: %v", parameters)
+	}
+	if parameters["json_list"] != `{"Standard_B1s":2}` || parameters["provenance"] != "{}" || parameters["profiles"] != "{}" || parameters["chart_version"] != "none" || parameters["fingerprint"] != "chart|profiles" {
+		t.Fatalf("unexpected record encoding: %v", parameters)
+	}
+
+	if err := s.Delete(ctx, "annotations", "uid"); err != nil {
+		t.Fatal(err)
+	}
+	if parameters["operation"] != "delete" || parameters["composition_id"] != "uid" {
+		t.Fatalf("unexpected parameters: %v", parameters)
+	}
+
+	fingerprints, err := s.List(ctx, "annotations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fingerprints) != 2 || fingerprints["a"] != "fa" || fingerprints["b"] != "" {
+		t.Fatalf("unexpected composition ids: %v", fingerprints)
+	}
+
+	if _, err := New(Config{Type: "unknown"}); err == nil {
+		t.Fatal("expected unknown sink types to be rejected")
+	}
+}
@@ -0,0 +1,331 @@
+package sink
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultOutboxMinBackoff is the delay before the first retry of a failed delivery
+	DefaultOutboxMinBackoff = 5 * time.Second
+	// DefaultOutboxMaxBackoff bounds the delay between the retries of a delivery
+	DefaultOutboxMaxBackoff = 5 * time.Minute
+	// outboxPollInterval is how often the outbox is scanned for the deliveries to retry
+	outboxPollInterval = time.Second
+	// outboxDeliveryTimeout bounds a single delivery to the sink
+	outboxDeliveryTimeout = time.Minute
+)
+
+// outboxEntry is a pending operation, stored as a JSON file in the outbox directory
+type outboxEntry struct {
+	Operation
+	// Id identifies this version of the entry, a newer operation on the same record replaces it
+	Id          string    `json:"id"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Outbox persists the upserts and deletes in a local directory, e.g. on a mounted volume, before they are
+// delivered to the sink by Run, so that an outage of the sink or a restart does not lose them. Failed
+// deliveries are retried with an exponential backoff until they succeed. Only the last pending operation
+// on each record is kept, since both upserts and deletes replace the whole record
+type Outbox struct {
+	Directory string
+	Sink      Sink
+
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// mutex guards the files of the outbox
+	mutex   sync.Mutex
+	counter uint64
+	notify  chan struct{}
+}
+
+// NewOutbox creates an outbox in the directory, created if missing, delivering to the sink. The operations
+// left pending by a previous run are delivered as well
+func NewOutbox(directory string, sink Sink) (*Outbox, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("error creating outbox directory: %w", err)
+	}
+	return &Outbox{
+		Directory:  directory,
+		Sink:       sink,
+		MinBackoff: DefaultOutboxMinBackoff,
+		MaxBackoff: DefaultOutboxMaxBackoff,
+		notify:     make(chan struct{}, 1),
+	}, nil
+}
+
+// Upsert stores the upsert in the outbox, it is delivered asynchronously
+func (o *Outbox) Upsert(ctx context.Context, table string, record Record) error {
+	return o.enqueue(Operation{Operation: "upsert", Table: table, CompositionId: record.CompositionId, Record: &record})
+}
+
+// Delete stores the delete in the outbox, it is delivered asynchronously
+func (o *Outbox) Delete(ctx context.Context, table string, compositionId string) error {
+	return o.enqueue(Operation{Operation: "delete", Table: table, CompositionId: compositionId})
+}
+
+// List returns the composition ids stored by the sink, updated with the operations still pending
+func (o *Outbox) List(ctx context.Context, table string) (map[string]string, error) {
+	fingerprints, err := o.Sink.List(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+
+	o.mutex.Lock()
+	entries, err := o.entries()
+	o.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.Table != table {
+			continue
+		}
+		switch entry.Operation.Operation {
+		case "upsert":
+			fingerprints[entry.CompositionId] = ""
+			if entry.Record != nil {
+				fingerprints[entry.CompositionId] = entry.Record.Fingerprint
+			}
+		case "delete":
+			delete(fingerprints, entry.CompositionId)
+		}
+	}
+	return fingerprints, nil
+}
+
+// Pending returns the number of operations not delivered yet
+func (o *Outbox) Pending() (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	entries, err := o.entries()
+	return len(entries), err
+}
+
+// Run delivers the pending operations to the sink until the context is done
+func (o *Outbox) Run(ctx context.Context) {
+	log.Info().Msgf("outbox delivering from %s", o.Directory)
+
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	for {
+		o.dispatch(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.notify:
+		}
+	}
+}
+
+// dispatch delivers the operations due, oldest first
+func (o *Outbox) dispatch(ctx context.Context) {
+	o.mutex.Lock()
+	entries, err := o.entries()
+	o.mutex.Unlock()
+	if err != nil {
+		log.Error().Err(err).Msg("error reading outbox")
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		if entry.NextAttempt.After(now) {
+			continue
+		}
+
+		err := o.deliver(ctx, entry)
+		if err == nil {
+			o.complete(entry)
+			log.Debug().Msgf("outbox delivered %s of %s in %s", entry.Operation.Operation, entry.CompositionId, entry.Table)
+			continue
+		}
+
+		entry.Attempts++
+		entry.LastError = err.Error()
+		entry.NextAttempt = time.Now().Add(o.backoff(entry.Attempts))
+		log.Warn().Err(err).Msgf("outbox could not deliver %s of %s in %s, attempt %d, retrying at %s",
+			entry.Operation.Operation, entry.CompositionId, entry.Table, entry.Attempts, entry.NextAttempt.Format(time.RFC3339))
+		o.reschedule(entry)
+	}
+}
+
+func (o *Outbox) deliver(ctx context.Context, entry *outboxEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, outboxDeliveryTimeout)
+	defer cancel()
+
+	switch entry.Operation.Operation {
+	case "upsert":
+		if entry.Record == nil {
+			return fmt.Errorf("upsert without record")
+		}
+		return o.Sink.Upsert(ctx, entry.Table, *entry.Record)
+	case "delete":
+		return o.Sink.Delete(ctx, entry.Table, entry.CompositionId)
+	default:
+		return fmt.Errorf("unknown operation %q", entry.Operation.Operation)
+	}
+}
+
+// backoff returns the delay before the given retry
+func (o *Outbox) backoff(attempts int) time.Duration {
+	delay := o.MinBackoff
+	for i := 1; i < attempts && delay < o.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > o.MaxBackoff {
+		delay = o.MaxBackoff
+	}
+	return delay
+}
+
+// enqueue stores the operation, replacing the one pending on the same record
+func (o *Outbox) enqueue(operation Operation) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.counter++
+	now := time.Now().UTC()
+	operation.Time = now
+	entry := &outboxEntry{
+		Operation: operation,
+		Id:        fmt.Sprintf("%d-%d", now.UnixNano(), o.counter),
+	}
+	if err := o.write(entry); err != nil {
+		return err
+	}
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// complete removes the delivered entry, unless a newer operation on the same record replaced it
+func (o *Outbox) complete(entry *outboxEntry) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if current, err := o.read(o.path(entry)); err != nil || current.Id != entry.Id {
+		return
+	}
+	if err := os.Remove(o.path(entry)); err != nil {
+		log.Error().Err(err).Msg("error removing delivered outbox entry")
+	}
+}
+
+// reschedule stores the retry of the entry, unless a newer operation on the same record replaced it
+func (o *Outbox) reschedule(entry *outboxEntry) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if current, err := o.read(o.path(entry)); err != nil || current.Id != entry.Id {
+		return
+	}
+	if err := o.write(entry); err != nil {
+		log.Error().Err(err).Msg("error rescheduling outbox entry")
+	}
+}
+
+// path returns the file of the pending operation on the record of the entry
+func (o *Outbox) path(entry *outboxEntry) string {
+	key := sha256.Sum256([]byte(entry.Table + "\x00" + entry.CompositionId))
+	return filepath.Join(o.Directory, hex.EncodeToString(key[:])+".json")
+}
+
+// write stores the entry durably: the file is synced and atomically renamed, then the directory is synced
+func (o *Outbox) write(entry *outboxEntry) error {
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error while converting outbox entry to json: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(o.Directory, temporaryPrefix)
+	if err != nil {
+		return fmt.Errorf("error creating outbox entry: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing outbox entry: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error syncing outbox entry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing outbox entry: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), o.path(entry)); err != nil {
+		return fmt.Errorf("error writing outbox entry: %w", err)
+	}
+
+	if dir, err := os.Open(o.Directory); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func (o *Outbox) read(path string) (*outboxEntry, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entry := &outboxEntry{}
+	if err := json.Unmarshal(content, entry); err != nil {
+		return nil, fmt.Errorf("error parsing outbox entry %s: %w", filepath.Base(path), err)
+	}
+	return entry, nil
+}
+
+// entries reads the pending entries, oldest first
+func (o *Outbox) entries() ([]*outboxEntry, error) {
+	files, err := os.ReadDir(o.Directory)
+	if err != nil {
+		return nil, fmt.Errorf("error reading outbox directory: %w", err)
+	}
+
+	entries := []*outboxEntry{}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || strings.HasPrefix(name, temporaryPrefix) || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		entry, err := o.read(filepath.Join(o.Directory, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			// A corrupted entry cannot be delivered, keep it for inspection and go on with the others
+			log.Error().Err(err).Msg("skipping outbox entry")
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries, nil
+}
@@ -0,0 +1,107 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakySink fails while down, and records the operations delivered otherwise
+type flakySink struct {
+	mutex     sync.Mutex
+	down      bool
+	delivered []string
+	stored    map[string]bool
+}
+
+func (f *flakySink) Upsert(ctx context.Context, table string, record Record) error {
+	return f.apply("upsert", record.CompositionId)
+}
+
+func (f *flakySink) Delete(ctx context.Context, table string, compositionId string) error {
+	return f.apply("delete", compositionId)
+}
+
+func (f *flakySink) List(ctx context.Context, table string) (map[string]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	fingerprints := map[string]string{}
+	for compositionId := range f.stored {
+		fingerprints[compositionId] = ""
+	}
+	return fingerprints, nil
+}
+
+func (f *flakySink) apply(operation, compositionId string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.down {
+		return fmt.Errorf("sink unavailable")
+	}
+	f.delivered = append(f.delivered, operation+" "+compositionId)
+	if operation == "upsert" {
+		f.stored[compositionId] = true
+	} else {
+		delete(f.stored, compositionId)
+	}
+	return nil
+}
+
+func TestOutboxSurvivesOutagesAndRestarts(t *testing.T) {
+	directory := t.TempDir()
+	inner := &flakySink{down: true, stored: map[string]bool{"old": true}}
+
+	outbox, err := NewOutbox(directory, inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox.MinBackoff = time.Millisecond
+	outbox.MaxBackoff = time.Millisecond
+
+	ctx := context.Background()
+	if err := outbox.Upsert(ctx, "annotations", Record{CompositionId: "a", Fingerprint: "fa"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.Upsert(ctx, "annotations", Record{CompositionId: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	// The delete replaces the pending upsert of b
+	if err := outbox.Delete(ctx, "annotations", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.Delete(ctx, "annotations", "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deliveries fail while the sink is down, the pending operations are listed anyway
+	outbox.dispatch(ctx)
+	if pending, err := outbox.Pending(); err != nil || pending != 3 {
+		t.Fatalf("expected 3 pending operations, got %d: %v", pending, err)
+	}
+	fingerprints, err := outbox.List(ctx, "annotations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fingerprints) != 1 || fingerprints["a"] != "fa" {
+		t.Fatalf("unexpected composition ids: %v", fingerprints)
+	}
+
+	// A new outbox on the same directory, as after a restart, delivers the pending operations in order
+	inner.down = false
+	restarted, err := NewOutbox(directory, inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	restarted.dispatch(ctx)
+
+	if pending, err := restarted.Pending(); err != nil || pending != 0 {
+		t.Fatalf("expected no pending operations, got %d: %v", pending, err)
+	}
+	want := []string{"upsert a", "delete b", "delete old"}
+	if fmt.Sprint(inner.delivered) != fmt.Sprint(want) {
+		t.Fatalf("expected deliveries %v, got %v", want, inner.delivered)
+	}
+}
@@ -0,0 +1,90 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	chartHelper "finops-composition-definition-parser/internal/helpers/chart"
+	notebookHelper "finops-composition-definition-parser/internal/helpers/notebook"
+)
+
+// Record is what is stored for a composition definition, or a composition instance, in a table
+type Record struct {
+	CompositionId string `json:"composition_id"`
+	// Keys maps each finops resource to its quantity summed over the chart
+	Keys map[string]float64 `json:"keys"`
+	// Provenance maps each finops resource to the chart manifests it was found in
+	Provenance map[string][]chartHelper.Provenance `json:"provenance"`
+	// Profiles maps the name of each values profile to the keys found with it
+	Profiles map[string]map[string]float64 `json:"profiles"`
+	// ChartVersion is the version of the chart the keys correspond to
+	ChartVersion string `json:"chart_version"`
+	// Fingerprint identifies the chart and values profiles the keys were extracted from, so that the unchanged
+	// composition definitions are not processed again after a restart
+	Fingerprint string `json:"fingerprint"`
+}
+
+// Sink stores the records of the compositions, in a table for each annotation label
+type Sink interface {
+	// Upsert stores the record, replacing the one stored for the same composition id
+	Upsert(ctx context.Context, table string, record Record) error
+	// Delete removes the record stored for the composition id, if any
+	Delete(ctx context.Context, table string, compositionId string) error
+	// List returns the composition ids stored in the table, mapped to the fingerprint of their record, empty if
+	// unknown
+	List(ctx context.Context, table string) (map[string]string, error)
+}
+
+// CredentialsFunc returns the username and password to access the database
+type CredentialsFunc func(ctx context.Context) (username string, password string, err error)
+
+// TypeNotebook uploads the records through the finops-database-handler notebook
+const TypeNotebook = "notebook"
+
+// Config selects the sink implementation and configures it
+type Config struct {
+	// Type is the sink implementation, the notebook by default
+	Type string
+	// NotebookUrl is the endpoint of the finops-database-handler notebook
+	NotebookUrl string
+	// NotebookOptions configures the timeouts, retries, circuit breaker and TLS of the notebook client
+	NotebookOptions notebookHelper.Options
+	// DatabaseUrl is the connection URL of the database sinks, e.g. postgres://cratedb:5432/doc
+	DatabaseUrl string
+	// Directory and FileFormat configure the file sink
+	Directory  string
+	FileFormat string
+	// Credentials returns the database credentials, for the sinks that need them
+	Credentials CredentialsFunc
+}
+
+// New creates the sink selected by the configuration
+func New(config Config) (Sink, error) {
+	switch strings.ToLower(config.Type) {
+	case "", TypeNotebook:
+		if config.NotebookUrl == "" {
+			return nil, fmt.Errorf("the %s sink needs the notebook URL", TypeNotebook)
+		}
+		client, err := notebookHelper.NewClient(config.NotebookUrl, config.NotebookOptions)
+		if err != nil {
+			return nil, err
+		}
+		return &Notebook{Client: client, Credentials: config.Credentials}, nil
+	case TypeCrate, TypePostgres:
+		if config.DatabaseUrl == "" {
+			return nil, fmt.Errorf("the %s sink needs the database URL", config.Type)
+		}
+		return NewDatabase(strings.ToLower(config.Type), config.DatabaseUrl, config.Credentials)
+	case TypeFile:
+		if config.Directory == "" {
+			return nil, fmt.Errorf("the %s sink needs the directory", TypeFile)
+		}
+		return NewFile(config.Directory, strings.ToLower(config.FileFormat))
+	case TypeStdout:
+		return &Stream{Writer: os.Stdout}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", config.Type)
+	}
+}
@@ -0,0 +1,122 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+
+	kubeHelper "finops-composition-definition-parser/internal/helpers/kube/client"
+	"finops-composition-definition-parser/internal/processor"
+	"finops-composition-definition-parser/internal/queue"
+)
+
+// Watcher uses a dynamic informer on CompositionDefinitions to trigger the processing of their charts,
+// without relying on the events sent by the eventrouter
+type Watcher struct {
+	DynClient    dynamic.Interface
+	Queue        queue.Enqueuer
+	ResyncPeriod time.Duration
+}
+
+// Run starts the informer and blocks until the context is cancelled
+func (w *Watcher) Run(ctx context.Context) error {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(w.DynClient, w.ResyncPeriod)
+	informer := factory.ForResource(kubeHelper.CompositionDefinitionResource).Informer()
+
+	_, err := informer.AddEventHandler(w.handlers())
+	if err != nil {
+		return fmt.Errorf("error adding event handler to informer: %w", err)
+	}
+
+	log.Info().Msgf("watching %s", kubeHelper.CompositionDefinitionResource.String())
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("timed out waiting for the informer cache to sync")
+	}
+
+	<-ctx.Done()
+	factory.Shutdown()
+	return nil
+}
+
+// handlers maps the informer notifications to the jobs of the queue
+func (w *Watcher) handlers() cache.ResourceEventHandlerDetailedFuncs {
+	return cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			// The composition definitions listed at startup are only processed if they changed since they were stored
+			if isInInitialList {
+				w.handleUpdate(obj)
+				return
+			}
+			w.handleCreate(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldUnstructured, okOld := oldObj.(*unstructured.Unstructured)
+			newUnstructured, okNew := newObj.(*unstructured.Unstructured)
+			// Only spec and values profiles changes are relevant, status updates and periodic resyncs keep the same generation
+			if okOld && okNew && oldUnstructured.GetGeneration() == newUnstructured.GetGeneration() &&
+				!processor.ProfileAnnotationsChanged(oldUnstructured, newUnstructured) {
+				return
+			}
+			w.handleUpdate(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			w.handleDelete(obj)
+		},
+	}
+}
+
+func (w *Watcher) handleCreate(obj interface{}) {
+	compositionObject, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		log.Error().Msgf("unexpected object of type %T from informer", obj)
+		return
+	}
+
+	log.Info().Msgf("informer event for composition definition %s %s", compositionObject.GetName(), compositionObject.GetNamespace())
+	w.Queue.Add(queue.Job{
+		Operation:     queue.OperationCreate,
+		CompositionId: string(compositionObject.GetUID()),
+		Object:        compositionObject,
+	})
+}
+
+func (w *Watcher) handleUpdate(obj interface{}) {
+	compositionObject, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		log.Error().Msgf("unexpected object of type %T from informer", obj)
+		return
+	}
+
+	log.Info().Msgf("informer update for composition definition %s %s, generation %d", compositionObject.GetName(), compositionObject.GetNamespace(), compositionObject.GetGeneration())
+	w.Queue.Add(queue.Job{
+		Operation:     queue.OperationUpdate,
+		CompositionId: string(compositionObject.GetUID()),
+		Object:        compositionObject,
+	})
+}
+
+func (w *Watcher) handleDelete(obj interface{}) {
+	// The informer may have missed the deletion and only know the last state of the object
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	compositionObject, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		log.Error().Msgf("unexpected object of type %T from informer", obj)
+		return
+	}
+
+	log.Info().Msgf("informer delete for composition definition %s %s", compositionObject.GetName(), compositionObject.GetNamespace())
+	w.Queue.Add(queue.Job{
+		Operation:     queue.OperationDelete,
+		CompositionId: string(compositionObject.GetUID()),
+	})
+}
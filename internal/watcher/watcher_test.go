@@ -0,0 +1,121 @@
+package watcher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/cache"
+
+	kubeHelper "finops-composition-definition-parser/internal/helpers/kube/client"
+	"finops-composition-definition-parser/internal/processor"
+	"finops-composition-definition-parser/internal/queue"
+)
+
+// jobs records the jobs enqueued by the watcher
+type jobs struct {
+	jobs  []queue.Job
+	mutex sync.Mutex
+}
+
+func (j *jobs) Add(job queue.Job) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.jobs = append(j.jobs, job)
+}
+
+// take returns the jobs recorded since the last call
+func (j *jobs) take() []queue.Job {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	taken := j.jobs
+	j.jobs = nil
+	return taken
+}
+
+func testCompositionDefinition(generation int64, annotations map[string]string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "core.krateo.io/v1alpha1",
+		"kind":       "CompositionDefinition",
+		"metadata":   map[string]interface{}{"name": "fireworksapp", "namespace": "krateo-system", "uid": "uid"},
+	}}
+	obj.SetGeneration(generation)
+	obj.SetAnnotations(annotations)
+	return obj
+}
+
+func TestWatcherHandlers(t *testing.T) {
+	enqueued := &jobs{}
+	w := &Watcher{Queue: enqueued}
+	handlers := w.handlers()
+
+	obj := testCompositionDefinition(1, nil)
+	tests := []struct {
+		name   string
+		notify func()
+		want   queue.Operation
+	}{
+		{"initial list", func() { handlers.OnAdd(obj, true) }, queue.OperationUpdate},
+		{"added", func() { handlers.OnAdd(obj, false) }, queue.OperationCreate},
+		{"same generation", func() { handlers.OnUpdate(obj, testCompositionDefinition(1, nil)) }, ""},
+		{"new generation", func() { handlers.OnUpdate(obj, testCompositionDefinition(2, nil)) }, queue.OperationUpdate},
+		{"profiles changed", func() {
+			handlers.OnUpdate(obj, testCompositionDefinition(1, map[string]string{processor.ProfilesAnnotation: "small: {}"}))
+		}, queue.OperationUpdate},
+		{"profiles configmap changed", func() {
+			handlers.OnUpdate(obj, testCompositionDefinition(1, map[string]string{processor.ProfilesConfigMapAnnotation: "profiles"}))
+		}, queue.OperationUpdate},
+		{"other annotation changed", func() {
+			handlers.OnUpdate(obj, testCompositionDefinition(1, map[string]string{"description": "fireworks"}))
+		}, ""},
+		{"deleted", func() { handlers.OnDelete(obj) }, queue.OperationDelete},
+		{"deleted while disconnected", func() {
+			handlers.OnDelete(cache.DeletedFinalStateUnknown{Key: "krateo-system/fireworksapp", Obj: obj})
+		}, queue.OperationDelete},
+		{"unexpected object", func() { handlers.OnDelete("fireworksapp") }, ""},
+	}
+	for _, test := range tests {
+		test.notify()
+		got := enqueued.take()
+		if test.want == "" {
+			if len(got) != 0 {
+				t.Fatalf("%s: expected no jobs, got %v", test.name, got)
+			}
+			continue
+		}
+		if len(got) != 1 || got[0].Operation != test.want || got[0].CompositionId != "uid" {
+			t.Fatalf("%s: expected a %s job for uid, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestWatcherInitialList(t *testing.T) {
+	dynClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		kubeHelper.CompositionDefinitionResource: "CompositionDefinitionList",
+	}, testCompositionDefinition(1, nil))
+	enqueued := &jobs{}
+	w := &Watcher{DynClient: dynClient, Queue: enqueued}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.Run(ctx) }()
+
+	// The composition definitions found at startup are updates, skipped by the processor if they did not change
+	deadline := time.Now().Add(5 * time.Second)
+	var got []queue.Job
+	for len(got) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		got = enqueued.take()
+	}
+	cancel()
+	// Cancelled right after the initial list, Run may still be waiting for the cache to sync
+	<-done
+	if len(got) != 1 || got[0].Operation != queue.OperationUpdate || got[0].CompositionId != "uid" {
+		t.Fatalf("expected an update job for uid, got %v", got)
+	}
+}
@@ -9,19 +9,13 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/rest"
 
 	corev1 "k8s.io/api/core/v1"
 
-	coreprovider "github.com/krateoplatformops/core-provider/apis/compositiondefinitions/v1alpha1"
-
 	types "finops-composition-definition-parser/apis"
-	chartHelper "finops-composition-definition-parser/internal/helpers/chart"
 	kubeHelper "finops-composition-definition-parser/internal/helpers/kube/client"
-	notebookHelper "finops-composition-definition-parser/internal/helpers/notebook"
+	"finops-composition-definition-parser/internal/queue"
 )
 
 const (
@@ -30,13 +24,10 @@ const (
 )
 
 type Webservice struct {
-	WebservicePort  int
-	NotebookUrl     string
-	AnnotationLabel string
-	AnnotationTable string
-	Config          *rest.Config
-	DynClient       *dynamic.DynamicClient
-	DatabaseConfig  types.NamespaceName
+	WebservicePort int
+	Queue          *queue.Queue
+	// ProcessCompositions enables the processing of the events on composition instances
+	ProcessCompositions bool
 }
 
 func (r *Webservice) handleHome(c *gin.Context) {
@@ -65,6 +56,11 @@ func (r *Webservice) handleAllEvents(c *gin.Context) {
 		return
 	}
 
+	if gv.Group == "composition.krateo.io" && r.ProcessCompositions {
+		r.handleCompositionEvent(c, &event)
+		return
+	}
+
 	if gv.Group != "core.krateo.io" && event.InvolvedObject.Kind != "CompositionDefinition" {
 		return
 	}
@@ -81,74 +77,62 @@ func (r *Webservice) handleAllEvents(c *gin.Context) {
 		Namespace:  event.InvolvedObject.Namespace,
 	}
 
-	dbUsername, dbPassword, err := kubeHelper.GetDatabaseUsernamePassword(c.Request.Context(), r.DatabaseConfig.Name, r.DatabaseConfig.Namespace, r.DynClient, r.Config)
-	if err != nil {
-		log.Error().Err(err).Msg("error while retrieving database username and password")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error while handling %s event: %s", event.Reason, err)})
-		return
-	}
-
 	// Get the composition definition unique id, used as primary key in the database
 	comppositionId := string(event.InvolvedObject.UID)
 
-	if event.Reason == "DeletedExternalResource" {
-		log.Info().Msgf("'%s' event for composition definition %s %s %s %s", event.Reason, composition.ApiVersion, composition.Resource, composition.Name, composition.Namespace)
-		if err := notebookHelper.CallNotebook(r.NotebookUrl, "delete", comppositionId, []byte("{}"), r.AnnotationTable, dbUsername, dbPassword); err != nil {
-			log.Error().Err(err).Msg("error while calling notebook")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error while handling %s event: %s", event.Reason, err)})
-			return
-		}
+	var operation queue.Operation
+	switch event.Reason {
+	case "DeletedExternalResource":
+		operation = queue.OperationDelete
+	case "CreatedExternalResource":
+		operation = queue.OperationCreate
+	case "UpdatedExternalResource":
+		// Chart upgrades re-extract the annotations from the new chart
+		operation = queue.OperationUpdate
+	default:
 		return
 	}
 
-	compositionObjectUnstructured, err := kubeHelper.GetObj(c.Request.Context(), composition, r.DynClient)
-	if err != nil {
-		log.Error().Err(err).Msg("retrieving object")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error while retrieving object: %s", err)})
+	log.Info().Msgf("'%s' event for composition definition %s %s %s %s", event.Reason, composition.ApiVersion, composition.Resource, composition.Name, composition.Namespace)
+
+	// The event is processed asynchronously, with retries
+	r.Queue.Add(queue.Job{
+		Operation:     operation,
+		CompositionId: comppositionId,
+		Reference:     composition,
+	})
+	c.JSON(http.StatusAccepted, gin.H{"status": "accepted"})
+}
+
+// handleCompositionEvent enqueues the processing of a composition instance. The composition is processed
+// once it is no longer creating, with the spec of the instance as values of the chart of its definition
+func (r *Webservice) handleCompositionEvent(c *gin.Context, event *corev1.Event) {
+	compositionId := string(event.InvolvedObject.UID)
+
+	var operation queue.Operation
+	switch event.Reason {
+	case "DeletedExternalResource":
+		operation = queue.OperationDeleteComposition
+	case "CreatedExternalResource", "UpdatedExternalResource":
+		operation = queue.OperationCreateComposition
+	default:
 		return
 	}
 
-	if event.Reason == "CreatedExternalResource" {
-		log.Info().Msgf("'%s' event for composition definition %s %s %s %s", event.Reason, composition.ApiVersion, composition.Resource, composition.Name, composition.Namespace)
-		// Transform the unstructured object into a CompositionDefinition
-		compositionObject := &coreprovider.CompositionDefinition{}
-		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(compositionObjectUnstructured.Object, compositionObject); err != nil {
-			log.Error().Err(err).Msg("error while converting from unstructured to composition definition")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error while handling %s event: %s", event.Reason, err)})
-			return
-		}
-
-		// Download, extract and then cleanup the download
-		defer chartHelper.CleanupDirectory(compositionObject.Spec.Chart.Repo)
-		_, err = chartHelper.ChartInfoFromSpec(compositionObject.Spec.Chart, "./", r.Config)
-		if err != nil {
-			log.Error().Err(err).Msg("error while downloading and extracting chart")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error while handling %s event: %s", event.Reason, err)})
-			return
-		}
-
-		// Get the list of all annotations with the given key
-		resourceMap, err := chartHelper.ProcessHelmTemplates(compositionObject.Spec.Chart.Repo, r.AnnotationLabel)
-		if err != nil {
-			log.Error().Err(err).Msg("error while processing chart")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error while handling %s event: %s", event.Reason, err)})
-			return
-		}
-
-		// Transform the annotations into a JSON object to send to the finops-database-handler notebook
-		jsonObject, err := json.Marshal(resourceMap)
-		if err != nil {
-			log.Error().Err(err).Msg("error while converting resources to json")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error while handling %s event: %s", event.Reason, err)})
-			return
-		}
-
-		if err := notebookHelper.CallNotebook(r.NotebookUrl, "create", comppositionId, jsonObject, r.AnnotationTable, dbUsername, dbPassword); err != nil {
-			log.Error().Err(err).Msg("error while calling notebook")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error while handling %s event: %s", event.Reason, err)})
-			return
-		}
-	}
+	log.Info().Msgf("'%s' event for composition %s %s %s %s", event.Reason, event.InvolvedObject.APIVersion, event.InvolvedObject.Kind, event.InvolvedObject.Name, event.InvolvedObject.Namespace)
+
+	r.Queue.Add(queue.Job{
+		Operation:     operation,
+		CompositionId: compositionId,
+		Reference: &types.Reference{
+			ApiVersion: event.InvolvedObject.APIVersion,
+			Kind:       event.InvolvedObject.Kind,
+			Resource:   kubeHelper.InferGroupResource(event.InvolvedObject.APIVersion, event.InvolvedObject.Kind).Resource,
+			Name:       event.InvolvedObject.Name,
+			Namespace:  event.InvolvedObject.Namespace,
+		},
+	})
+	c.JSON(http.StatusAccepted, gin.H{"status": "accepted"})
 }
 
 func (r *Webservice) Spinup() {
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"context"
+	chartHelper "finops-composition-definition-parser/internal/helpers/chart"
 	parser "finops-composition-definition-parser/internal/helpers/configuration"
 	kubeHelper "finops-composition-definition-parser/internal/helpers/kube/client"
+	secretsHelper "finops-composition-definition-parser/internal/helpers/kube/secrets"
+	notebookHelper "finops-composition-definition-parser/internal/helpers/notebook"
+	"finops-composition-definition-parser/internal/processor"
+	"finops-composition-definition-parser/internal/queue"
+	"finops-composition-definition-parser/internal/resync"
+	"finops-composition-definition-parser/internal/sink"
+	"finops-composition-definition-parser/internal/watcher"
 	"finops-composition-definition-parser/internal/webservice"
 	"os"
 
@@ -13,18 +22,16 @@ import (
 
 func main() {
 	configuration, err := parser.ParseConfig()
-	if err != nil {
-		configuration.Default()
-	}
 
 	// Logger configuration
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	zerolog.SetGlobalLevel(configuration.DebugLevel)
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 
+	// Without a valid configuration there is no sink to store the annotations in, nor labels to extract
 	if err != nil {
-		log.Error().Err(err).Msg("configuration missing")
-		log.Info().Msg("using default configuration for webservice")
+		log.Error().Err(err).Msg("parsing configuration")
+		return
 	}
 
 	log.Debug().Msg("List of environment variables:")
@@ -45,15 +52,135 @@ func main() {
 		return
 	}
 
+	extractLimits := chartHelper.DefaultExtractLimits
+	if configuration.ExtractMaxFileSize > 0 {
+		extractLimits.MaxFileSize = configuration.ExtractMaxFileSize
+	}
+	if configuration.ExtractMaxTotalSize > 0 {
+		extractLimits.MaxTotalSize = configuration.ExtractMaxTotalSize
+	}
+	if configuration.ExtractMaxFiles > 0 {
+		extractLimits.MaxFiles = int(configuration.ExtractMaxFiles)
+	}
+
+	// Secrets are read through a single accessor, shared by the chart and database credentials
+	secrets, err := secretsHelper.NewAccessor(rcConfig, secretsHelper.Options{
+		Namespace: configuration.SecretsNamespace,
+		Informer:  configuration.SecretsInformer,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("creating secrets accessor")
+		return
+	}
+	if err := secrets.Start(context.Background()); err != nil {
+		log.Error().Err(err).Msg("starting secrets informer")
+		return
+	}
+
+	// The database credentials are read from the DatabaseConfig once, and again after it or its Secret change.
+	// Without a DatabaseConfig, the database sinks use the credentials of their URL
+	var credentials sink.CredentialsFunc
+	if configuration.DatabaseConfig.Name != "" {
+		databaseCredentials := &kubeHelper.DatabaseCredentials{
+			Name:      configuration.DatabaseConfig.Name,
+			Namespace: configuration.DatabaseConfig.Namespace,
+			DynClient: dynClient,
+			Secrets:   secrets,
+		}
+		go func() {
+			if err := databaseCredentials.Run(context.Background()); err != nil {
+				log.Error().Err(err).Msg("database config watcher stopped")
+			}
+		}()
+		credentials = databaseCredentials.Get
+	}
+
+	notebookOptions := notebookHelper.Options{
+		Timeout:          configuration.NotebookTimeout,
+		MaxRetries:       configuration.NotebookMaxRetries,
+		BreakerThreshold: configuration.NotebookBreakerThreshold,
+		BreakerCooldown:  configuration.NotebookBreakerCooldown,
+		CAFile:           configuration.NotebookCAFile,
+		CertFile:         configuration.NotebookCertFile,
+		KeyFile:          configuration.NotebookKeyFile,
+		VerifyWrites:     configuration.NotebookVerifyWrites,
+	}
+	if notebookOptions.MaxRetries == 0 {
+		// A zero value in the options means the default, negative disables the retries
+		notebookOptions.MaxRetries = -1
+	}
+
+	annotationSink, err := sink.New(sink.Config{
+		Type:            configuration.SinkType,
+		NotebookUrl:     configuration.WebserviceUrl,
+		NotebookOptions: notebookOptions,
+		DatabaseUrl:     configuration.SinkDatabaseUrl,
+		Directory:       configuration.SinkDirectory,
+		FileFormat:      configuration.SinkFileFormat,
+		Credentials:     credentials,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("creating annotation sink")
+		return
+	}
+
+	// Optionally persist the operations in the outbox, delivered to the sink in the background
+	if configuration.OutboxDirectory != "" {
+		outbox, err := sink.NewOutbox(configuration.OutboxDirectory, annotationSink)
+		if err != nil {
+			log.Error().Err(err).Msg("creating outbox")
+			return
+		}
+		go outbox.Run(context.Background())
+		annotationSink = outbox
+	}
+
+	p := &processor.Processor{
+		Config:           rcConfig,
+		DynClient:        dynClient,
+		Secrets:          secrets,
+		Sink:             annotationSink,
+		WorkingDirectory: configuration.WorkingDir,
+		ExtractLimits:    extractLimits,
+		InMemory:         configuration.ChartInMemory,
+
+		FetchDependencies:  configuration.FetchDependencies,
+		ProfilesNamespaces: configuration.ProfilesNamespaces,
+		Mappings:           configuration.AnnotationMappings,
+	}
+
+	// Events are processed asynchronously by the workers of the queue
+	q := queue.New(p, configuration.QueueMaxRetries)
+	go q.Run(context.Background(), configuration.QueueWorkers)
+
+	// Optionally watch CompositionDefinitions directly, so that the eventrouter is not required
+	if configuration.WatchMode {
+		cw := watcher.Watcher{
+			DynClient: dynClient,
+			Queue:     q,
+		}
+		go func() {
+			if err := cw.Run(context.Background()); err != nil {
+				log.Error().Err(err).Msg("composition definition watcher stopped")
+			}
+		}()
+	}
+
+	// Rebuild the annotation table at startup and then periodically
+	rs := resync.Resyncer{
+		DynClient: dynClient,
+		Processor: p,
+		Queue:     q,
+		Interval:  configuration.ResyncInterval,
+	}
+	go rs.Run(context.Background())
+
 	// // Start webservice to serve endpoints
 	w := webservice.Webservice{
-		Config:          rcConfig,
-		WebservicePort:  configuration.WebServicePort,
-		AnnotationLabel: configuration.AnnotationLabel,
-		AnnotationTable: configuration.AnnotationTable,
-		DynClient:       dynClient,
-		NotebookUrl:     configuration.WebserviceUrl,
-		DatabaseConfig:  configuration.DatabaseConfig,
+		WebservicePort: configuration.WebServicePort,
+		Queue:          q,
+
+		ProcessCompositions: configuration.ProcessCompositions,
 	}
 	w.Spinup() // blocks main thread
 }